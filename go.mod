@@ -2,4 +2,12 @@ module github.com/tech10/nvdaRemoteServer
 
 go 1.20
 
-require github.com/tech10/panichandler v1.6.7
+require (
+	github.com/tech10/panichandler v1.6.7
+	golang.org/x/crypto v0.33.0
+)
+
+require (
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
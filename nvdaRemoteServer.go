@@ -5,7 +5,6 @@ import (
 	"os"
 	"runtime/debug"
 	"strings"
-	"sync"
 
 	. "github.com/tech10/nvdaRemoteServer/server"
 )
@@ -33,27 +32,13 @@ func main() {
 	}
 	defer PanicHandle.Catch()
 	PidfileSet()
+	Ready()
 	Log(LOG_INFO, "Server started. Running under PID "+PID_STR+". Server version "+Version)
-	wait()
+	Wait()
 	Shutdown()
 	Log(LOG_INFO, "Server shutdown complete.")
 }
 
-func wait() {
-	var wg sync.WaitGroup
-	for _, s := range Servers {
-		if s == nil {
-			continue
-		}
-		wg.Add(1)
-		go func(sv *Server) {
-			sv.Wait()
-			wg.Done()
-		}(s)
-	}
-	wg.Wait()
-}
-
 func args() {
 	if len(os.Args) < 2 {
 		return
@@ -65,6 +50,12 @@ func args() {
 	case "buildinfo":
 		fmt.Println(buildInfo())
 		os.Exit(0)
+	case "admin":
+		os.Exit(Admin(os.Args[2:]))
+	case "replay":
+		os.Exit(Replay(os.Args[2:]))
+	case "audit-verify":
+		os.Exit(AuditVerify(os.Args[2:]))
 	default:
 		return
 	}
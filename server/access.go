@@ -0,0 +1,41 @@
+package server
+
+type accessSettings struct {
+	allow    netList
+	deny     netList
+	logLevel int
+}
+
+func (h *Hub) accessSettings() accessSettings {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return accessSettings{
+		allow:    h.allowNets,
+		deny:     h.denyNets,
+		logLevel: h.opts.DenyLogLevel,
+	}
+}
+
+// Decide if an IP address may connect. The deny list takes priority over the allow list, and an empty allow list allows every address.
+func access_check(as accessSettings, ip string) (bool, string) {
+	if as.deny.Contains(ip) {
+		return false, "it is in the deny list"
+	}
+	if len(as.allow) > 0 && !as.allow.Contains(ip) {
+		return false, "it is not in the allow list"
+	}
+	return true, ""
+}
+
+// Returns false and logs the refusal if a connection must be closed before the TLS handshake.
+func (s *Server) access(ip string) bool {
+	as := s.hub.accessSettings()
+	allowed, reason := access_check(as, ip)
+	if allowed {
+		return true
+	}
+	s.hub.stats.denied.Add(1)
+	s.hub.audit(auditEntry{Event: "connection_denied", IP: ip, Reason: reason})
+	s.hub.Log(as.logLevel, "Connection from "+ip+" to the server at "+s.address+" has been denied, because "+reason+".")
+	return false
+}
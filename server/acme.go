@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	hl               sync.Mutex
+	acme_http_server *http.Server
+)
+
+func acme_manager(domains DomainList, email, directory, cacheDir, caFile string) (*autocert.Manager, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("No domains have been given to obtain a certificate for.")
+	}
+	for _, d := range domains {
+		err := domain_valid(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := &acme.Client{
+		DirectoryURL: directory,
+	}
+	if caFile != "" {
+		d, err := file_read(caFile)
+		if err != nil {
+			return nil, errors.New("Unable to read the ACME certificate authority file " + caFile + "\n" + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(d) {
+			return nil, errors.New("No certificates were found in the ACME certificate authority file " + caFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					RootCAs:    pool,
+					MinVersion: tls.VersionTLS12,
+				},
+			},
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(fullPath(cacheDir)),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client:     client,
+	}, nil
+}
+
+// Answer HTTP-01 challenges on an extra address, usually port 80.
+func acme_http_listen(address string, m *autocert.Manager) error {
+	if address == "" || m == nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: time.Duration(write_sec) * time.Second,
+	}
+	hl.Lock()
+	acme_http_server = hs
+	hl.Unlock()
+	Log(LOG_DEBUG, "Answering ACME HTTP-01 challenges on address "+address)
+	go func() {
+		err := hs.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			Log_error("ACME HTTP-01 challenge server at " + address + " has stopped.\r\n" + err.Error())
+		}
+	}()
+	go func() {
+		<-defaultHub.ctx.Done()
+		acme_http_close()
+	}()
+	return nil
+}
+
+func acme_http_close() {
+	hl.Lock()
+	defer hl.Unlock()
+	if acme_http_server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(write_sec)*time.Second)
+	defer cancel()
+	_ = acme_http_server.Shutdown(ctx)
+	acme_http_server = nil
+}
+
+// Obtain certificates as soon as the server has started, rather than on the first connection.
+func acme_prefetch(cs *certStore, domains DomainList) {
+	for _, d := range domains {
+		Log(LOG_DEBUG, "Obtaining a certificate for "+d)
+		_, err := cs.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:      d,
+			CipherSuites:    []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SupportedCurves: []tls.CurveID{tls.CurveP256},
+		})
+		if err != nil {
+			Log_error("Unable to obtain a certificate for " + d + "\r\n" + err.Error())
+			continue
+		}
+		Log(LOG_INFO, "A certificate for "+d+" is ready.")
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func pebble_env(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
+
+// Obtain a certificate from Pebble, skipped unless PEBBLE_DIRECTORY and PEBBLE_CA_FILE are set.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY isn't set.")
+	}
+	domain := pebble_env("PEBBLE_DOMAIN", "localhost.localdomain")
+	m, err := acme_manager(DomainList{domain}, "", directory, t.TempDir(), os.Getenv("PEBBLE_CA_FILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = acme_http_listen(pebble_env("PEBBLE_HTTP_ADDRESS", ":5002"), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acme_http_close()
+
+	// TLS-ALPN-01 challenges are answered during the handshake, in the same way the server answers them.
+	listener, err := tls.Listen("tcp", pebble_env("PEBBLE_TLS_ADDRESS", ":5001"), &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				_ = c.(*tls.Conn).Handshake()
+				c.Close()
+			}(conn)
+		}
+	}()
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      domain,
+		CipherSuites:    []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves: []tls.CurveID{tls.CurveP256},
+	})
+	if err != nil {
+		t.Fatal("Unable to obtain a certificate for " + domain + ": " + err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leaf.VerifyHostname(domain); err != nil {
+		t.Fatal(err)
+	}
+}
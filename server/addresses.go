@@ -31,6 +31,15 @@ func (a *AddressList) Set(v string) error {
 	return nil
 }
 
+func (a AddressList) Contains(address string) bool {
+	for _, v := range a {
+		if v == address {
+			return true
+		}
+	}
+	return false
+}
+
 func address_valid(v string) error {
 	var ip string
 	var portstr string
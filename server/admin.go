@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const admin_sec int = 10
+
+type AdminRequest struct {
+	Command string `json:"command"`
+	ID      int    `json:"id,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Message string `json:"message,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+type AdminResponse struct {
+	Error    string             `json:"error,omitempty"`
+	Message  string             `json:"message,omitempty"`
+	Clients  []AdminClientData  `json:"clients,omitempty"`
+	Channels []AdminChannelData `json:"channels,omitempty"`
+	Bans     []AdminBanData     `json:"bans,omitempty"`
+}
+
+type AdminClientData struct {
+	ID             int       `json:"id"`
+	IP             string    `json:"ip"`
+	ConnectionType string    `json:"connection_type,omitempty"`
+	Channel        string    `json:"channel,omitempty"`
+	Version        int       `json:"version,omitempty"`
+	Authorized     bool      `json:"authorized"`
+	LastReceived   time.Time `json:"last_received"`
+}
+
+type AdminChannelData struct {
+	Name    string `json:"name"`
+	Locked  bool   `json:"locked"`
+	Clients int    `json:"clients"`
+	Masters int    `json:"masters"`
+	Slaves  int    `json:"slaves"`
+}
+
+type AdminBanData struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Count  int       `json:"count"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+var (
+	al             sync.Mutex
+	admin_listener net.Listener
+	admin_path     string
+)
+
+var adminCommand = make(map[string]func(*AdminRequest) AdminResponse)
+
+func admin_add(cmd string, cfunc func(*AdminRequest) AdminResponse) {
+	adminCommand[cmd] = cfunc
+}
+
+func admin_exec(req *AdminRequest) AdminResponse {
+	if req.Command == "" {
+		return AdminResponse{Error: "Invalid parameters received, a command cannot be blank."}
+	}
+	cfunc, exists := adminCommand[req.Command]
+	if !exists {
+		return AdminResponse{Error: "The command " + req.Command + " does not exist."}
+	}
+	return cfunc(req)
+}
+
+func admin_error(err string) AdminResponse {
+	return AdminResponse{Error: err}
+}
+
+func init() {
+	admin_add("list_clients", func(req *AdminRequest) AdminResponse {
+		return AdminResponse{Clients: defaultHub.ListClients()}
+	})
+
+	admin_add("list_channels", func(req *AdminRequest) AdminResponse {
+		return AdminResponse{Channels: defaultHub.ListChannels()}
+	})
+
+	admin_add("kick_client", func(req *AdminRequest) AdminResponse {
+		c := defaultHub.FindClientID(req.ID)
+		if c == nil {
+			return admin_error("Client " + strconv.Itoa(req.ID) + " is not connected.")
+		}
+		Log(LOG_INFO, "Client "+strconv.Itoa(req.ID)+" has been kicked by an administrator.")
+		defaultHub.audit(auditEntry{Event: "client_kicked", Client: req.ID, IP: c.GetIP()})
+		c.Close()
+		return AdminResponse{Message: "Client " + strconv.Itoa(req.ID) + " has been kicked."}
+	})
+
+	admin_add("close_channel", func(req *AdminRequest) AdminResponse {
+		cc := defaultHub.FindChannel(req.Channel)
+		if cc == nil {
+			return admin_error("The channel " + req.Channel + " does not exist.")
+		}
+		Log(LOG_INFO, "Channel "+log_secret(req.Channel)+" has been closed by an administrator.", log_fields("channel_closed").Channel(req.Channel))
+		defaultHub.audit(auditEntry{Event: "channel_closed", Channel: req.Channel})
+		num := 0
+		for _, c := range cc.Clients() {
+			c.Close()
+			num++
+		}
+		return AdminResponse{Message: "Channel " + req.Channel + " has been closed, disconnecting " + strconv.Itoa(num) + " clients."}
+	})
+
+	admin_add("broadcast", func(req *AdminRequest) AdminResponse {
+		if req.Message == "" {
+			return admin_error("A message to broadcast cannot be blank.")
+		}
+		enc, encerr := Encode(Data{
+			Type:              "motd",
+			Motd:              req.Message,
+			MotdAlwaysDisplay: true,
+		})
+		if encerr != nil {
+			return admin_error("Unable to encode the message.\n" + encerr.Error())
+		}
+		var ccl []*ClientChannel
+		if req.Channel != "" {
+			cc := defaultHub.FindChannel(req.Channel)
+			if cc == nil {
+				return admin_error("The channel " + req.Channel + " does not exist.")
+			}
+			ccl = []*ClientChannel{cc}
+		} else {
+			ccl = defaultHub.channelList()
+		}
+		num := 0
+		for _, cc := range ccl {
+			for _, c := range cc.Clients() {
+				c.Send(enc)
+				num++
+			}
+		}
+		Log(LOG_INFO, "An administrator has broadcast a message to "+strconv.Itoa(num)+" clients.\r\n"+req.Message)
+		return AdminResponse{Message: "Message sent to " + strconv.Itoa(num) + " clients."}
+	})
+
+	admin_add("upgrade", func(req *AdminRequest) AdminResponse {
+		// Starting the new process can take longer than an admin request is allowed to.
+		go func() {
+			err := upgrade()
+			if err != nil {
+				Log_error("Unable to upgrade the server.\r\n" + err.Error())
+			}
+		}()
+		Log(LOG_INFO, "An upgrade has been requested by an administrator.")
+		return AdminResponse{Message: "The upgrade has been started. Its progress will be logged."}
+	})
+
+	admin_add("list_bans", func(req *AdminRequest) AdminResponse {
+		return AdminResponse{Bans: ListBans()}
+	})
+
+	admin_add("unban", func(req *AdminRequest) AdminResponse {
+		if req.IP == "" {
+			return admin_error("An IP address to unban cannot be blank.")
+		}
+		if !bans.Unban(req.IP) {
+			return admin_error("The IP address " + req.IP + " is not banned.")
+		}
+		Log(LOG_INFO, "The IP address "+req.IP+" has been unbanned by an administrator.")
+		defaultHub.audit(auditEntry{Event: "unbanned", IP: req.IP})
+		return AdminResponse{Message: "The IP address " + req.IP + " has been unbanned."}
+	})
+
+	admin_add("clear_bans", func(req *AdminRequest) AdminResponse {
+		num := bans.Clear()
+		Log(LOG_INFO, "All bans have been cleared by an administrator.")
+		defaultHub.audit(auditEntry{Event: "bans_cleared", Reason: strconv.Itoa(num) + " IP addresses were unbanned."})
+		return AdminResponse{Message: strconv.Itoa(num) + " IP addresses have been unbanned."}
+	})
+}
+
+// Snapshot of every connected client, sorted by ID.
+func (h *Hub) ListClients() []AdminClientData {
+	cl := h.clientList()
+	list := make([]AdminClientData, 0, len(cl))
+	for _, c := range cl {
+		cd := AdminClientData{
+			ID:             c.GetID(),
+			IP:             c.GetIP(),
+			ConnectionType: c.GetConnectionType(),
+			Version:        c.GetVersion(),
+			Authorized:     c.GetAuthorized(),
+			LastReceived:   c.GetLastReceived(),
+		}
+		cc := c.GetChannel()
+		if cc != nil {
+			cd.Channel = cc.Name()
+		}
+		list = append(list, cd)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Snapshot of every active ban, sorted by expiry.
+func ListBans() []AdminBanData {
+	bl := bans.List()
+	list := make([]AdminBanData, 0, len(bl))
+	for _, e := range bl {
+		list = append(list, AdminBanData{
+			IP:     e.IP,
+			Until:  e.Until,
+			Count:  e.Count,
+			Reason: e.Reason,
+		})
+	}
+	return list
+}
+
+// Snapshot of every channel, sorted by name.
+func (h *Hub) ListChannels() []AdminChannelData {
+	ccl := h.channelList()
+	list := make([]AdminChannelData, 0, len(ccl))
+	for _, cc := range ccl {
+		cc.Lock()
+		list = append(list, AdminChannelData{
+			Name:    cc.name,
+			Locked:  cc.locked,
+			Clients: len(cc.ClientsAll),
+			Masters: len(cc.ClientsMaster),
+			Slaves:  len(cc.ClientsSlave),
+		})
+		cc.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func admin_listen(path string) error {
+	if path == "" {
+		return nil
+	}
+	path = fullPath(path)
+	if _, err := os.Stat(path); err == nil {
+		conn, derr := net.DialTimeout("unix", path, time.Second)
+		if derr == nil {
+			conn.Close()
+			return errors.New("The admin socket at " + path + " is in use by another process.")
+		}
+		Log(LOG_DEBUG, "Removing stale admin socket "+path)
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	path, err = fileOps(path)
+	if err != nil {
+		return err
+	}
+	// The socket is created without permissions for anyone else, so there is no moment where another user can connect before it is changed.
+	restore := umask_private()
+	listener, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(path, 0o600)
+	if err != nil {
+		Log(LOG_DEBUG, "Unable to change permissions of the admin socket at "+path+"\r\n"+err.Error())
+	}
+	al.Lock()
+	admin_listener = listener
+	admin_path = path
+	al.Unlock()
+	Log(LOG_DEBUG, "Admin socket listening at "+path)
+	go func() {
+		<-defaultHub.ctx.Done()
+		admin_close()
+	}()
+	go admin_accept(listener)
+	return nil
+}
+
+func admin_accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			defaultHub.msl.Lock()
+			if !defaultHub.stopping && !errors.Is(err, net.ErrClosed) {
+				Log(LOG_DEBUG, "Error accepting connections on the admin socket.\r\n"+err.Error())
+			}
+			defaultHub.msl.Unlock()
+			return
+		}
+		go admin_handle(conn)
+	}
+}
+
+func admin_handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(admin_sec) * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		Log(LOG_DEBUG, "Error receiving admin request.\r\n"+err.Error())
+		return
+	}
+	var req AdminRequest
+	var res AdminResponse
+	err = json.Unmarshal(line, &req)
+	if err != nil {
+		res = admin_error("Invalid request.\n" + err.Error())
+	} else {
+		Log(LOG_DEBUG, "Received admin command "+req.Command)
+		res = admin_exec(&req)
+	}
+	enc, err := Encode(res)
+	if err != nil {
+		Log(LOG_DEBUG, "JSON encoding error for admin response.\r\n"+err.Error())
+		return
+	}
+	_, _ = conn.Write(append(enc, '\n'))
+}
+
+func admin_close() {
+	al.Lock()
+	defer al.Unlock()
+	if admin_listener == nil {
+		return
+	}
+	admin_listener.Close()
+	admin_listener = nil
+	// Closing a unix listener normally unlinks the socket, but make sure.
+	if fileExists(admin_path) {
+		_ = os.Remove(admin_path)
+	}
+	admin_path = ""
+}
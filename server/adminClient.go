@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const adminUsage = `Usage: nvdaRemoteServer admin [-socket path] [-conf-file path] [-channel name] command [arguments]
+
+Commands:
+  clients             List all connected clients.
+  channels            List all channels.
+  kick id             Disconnect the client with the given ID.
+  close channel       Disconnect every client in the given channel.
+  broadcast message   Send a message of the day to every client in a channel, or all channels if -channel is unset.
+  bans                List all banned IP addresses.
+  unban ip            Remove the ban on the given IP address.
+  unban all           Remove every ban.
+  upgrade             Start the server's executable again, handing over every listening address, without disconnecting any client.
+`
+
+// Run an admin subcommand against the admin socket of a running server, returning the exit code.
+func Admin(args []string) int {
+	var socket string
+	var channel string
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	fs.Usage = func() {
+		fmt.Print(adminUsage + "\nParameters:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&socket, "socket", DEFAULT_ADMIN_SOCKET, "Path to the admin socket. If this is empty, the admin_socket parameter will be read from the configuration file.")
+	fs.StringVar(&confFile, "conf-file", DEFAULT_CONF_FILE, "Path to the configuration file the server is using.")
+	fs.BoolVar(&confRead, "conf-read", DEFAULT_CONF_READ, "Whether or not to read a configuration file to find the admin socket.")
+	fs.StringVar(&channel, "channel", "", "Channel to send a broadcast message to.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	req, err := admin_request(fs.Args(), channel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if socket == "" {
+		c := cfg_default()
+		err = c.Read()
+		if err == nil {
+			socket = c.AdminSocket
+		}
+		if socket == "" {
+			fmt.Fprintln(os.Stderr, "No admin socket has been given, and none could be found in a configuration file.")
+			return 1
+		}
+	}
+	res, err := admin_send(socket, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to communicate with the server through the admin socket at "+socket+"\n"+err.Error())
+		return 1
+	}
+	if res.Error != "" {
+		fmt.Fprintln(os.Stderr, res.Error)
+		return 1
+	}
+	admin_print(req, res)
+	return 0
+}
+
+func admin_request(args []string, channel string) (*AdminRequest, error) {
+	req := &AdminRequest{}
+	switch args[0] {
+	case "clients":
+		req.Command = "list_clients"
+	case "channels":
+		req.Command = "list_channels"
+	case "kick":
+		if len(args) < 2 {
+			return nil, errors.New("A client ID is required.")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, errors.New("Invalid client ID " + args[1])
+		}
+		req.Command = "kick_client"
+		req.ID = id
+	case "close":
+		if len(args) < 2 {
+			return nil, errors.New("A channel name is required.")
+		}
+		req.Command = "close_channel"
+		req.Channel = args[1]
+	case "broadcast":
+		if len(args) < 2 {
+			return nil, errors.New("A message is required.")
+		}
+		req.Command = "broadcast"
+		req.Channel = channel
+		req.Message = strings.Join(args[1:], " ")
+	case "bans":
+		req.Command = "list_bans"
+	case "unban":
+		if len(args) < 2 {
+			return nil, errors.New("An IP address is required.")
+		}
+		if args[1] == "all" {
+			req.Command = "clear_bans"
+			break
+		}
+		req.Command = "unban"
+		req.IP = args[1]
+	case "upgrade":
+		req.Command = "upgrade"
+	default:
+		return nil, errors.New("Unknown admin command " + args[0])
+	}
+	return req, nil
+}
+
+func admin_send(socket string, req *AdminRequest) (*AdminResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Duration(admin_sec)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(admin_sec) * time.Second))
+	enc, err := Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(enc, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	res := &AdminResponse{}
+	err = json.Unmarshal(line, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func admin_print(req *AdminRequest, res *AdminResponse) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch req.Command {
+	case "list_clients":
+		if len(res.Clients) == 0 {
+			fmt.Fprintln(w, "No clients are connected.")
+			return
+		}
+		fmt.Fprintln(w, "ID\tIP\tTYPE\tCHANNEL\tVERSION\tAUTHORIZED\tIDLE")
+		for _, c := range res.Clients {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%t\t%s\n", c.ID, c.IP, c.ConnectionType, c.Channel, c.Version, c.Authorized, time.Since(c.LastReceived).Round(time.Second))
+		}
+	case "list_channels":
+		if len(res.Channels) == 0 {
+			fmt.Fprintln(w, "There are no channels.")
+			return
+		}
+		fmt.Fprintln(w, "NAME\tLOCKED\tCLIENTS\tMASTERS\tSLAVES")
+		for _, c := range res.Channels {
+			fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%d\n", c.Name, c.Locked, c.Clients, c.Masters, c.Slaves)
+		}
+	case "list_bans":
+		if len(res.Bans) == 0 {
+			fmt.Fprintln(w, "No IP addresses are banned.")
+			return
+		}
+		fmt.Fprintln(w, "IP\tUNTIL\tBANS\tREASON")
+		for _, b := range res.Bans {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", b.IP, b.Until.Local().Format(time.RFC1123), b.Count, b.Reason)
+		}
+	default:
+		fmt.Fprintln(w, res.Message)
+	}
+}
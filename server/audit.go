@@ -0,0 +1,490 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Longest audit entry that will be read when verifying the audit file, or looking for its last entry.
+const audit_entry_max int = 64 * 1024
+
+// How often the head file is brought up to date with the last entry.
+const audit_head_interval time.Duration = time.Second
+
+// Most entries kept while the audit file is held.
+const audit_held_max int = 10000
+
+type auditEntry struct {
+	Seq            uint64 `json:"seq"`
+	Time           string `json:"time"`
+	Event          string `json:"event"`
+	Client         int    `json:"client_id,omitempty"`
+	IP             string `json:"ip,omitempty"`
+	Channel        string `json:"channel,omitempty"`
+	ConnectionType string `json:"connection_type,omitempty"`
+	Authorized     *bool  `json:"authorized,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	// Must remain the last field, since it is left out of the data it is calculated from.
+	HMAC string `json:"hmac,omitempty"`
+}
+
+func audit_bool(b bool) *bool {
+	return &b
+}
+
+// An append-only log of security relevant events, chained with HMACs if there is a key.
+type auditLog struct {
+	sync.Mutex
+	f       *os.File
+	key     []byte
+	seq     uint64
+	prev    string
+	failing bool
+	// Held while writing the head file, which is done outside the main lock.
+	hl sync.Mutex
+	// The sequence number of the last entry written to the head file.
+	headSeq uint64
+	// Closed to stop writing the head file.
+	done chan struct{}
+	// Entries added while the audit file is held, written once a file is opened.
+	holding bool
+	held    []auditEntry
+	// The hub failures to write the audit file are logged through.
+	hub *Hub
+}
+
+var audits = &auditLog{}
+
+// Open the audit file, continuing the sequence and HMAC chain from its last entry. An empty file disables the audit trail.
+func (a *auditLog) Open(file, keyFile string) error {
+	if file == "" {
+		return nil
+	}
+	var key []byte
+	if keyFile != "" {
+		var err error
+		key, err = audit_key(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	file, err := fileOps(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	last, err := audit_last(f)
+	if err != nil {
+		_ = f.Close()
+		return errors.New("Unable to read the last entry of the audit file " + file + "\n" + err.Error())
+	}
+	if key != nil {
+		// A file that has been cut short mustn't have its head written again.
+		var h auditHead
+		h, err = audit_head_read(file, key)
+		if err == nil {
+			err = audit_head_check(file, h, last.Seq, last.HMAC)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err == nil {
+			err = audit_head_write(file, key, last.Seq, last.HMAC)
+		}
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.f = f
+	a.key = key
+	a.seq = last.Seq
+	a.prev = last.HMAC
+	a.hl.Lock()
+	a.headSeq = last.Seq
+	a.hl.Unlock()
+	if key != nil {
+		a.done = make(chan struct{})
+		go a.headWatch(a.done)
+	}
+	for _, e := range a.held {
+		a.write(e)
+	}
+	a.holding = false
+	a.held = nil
+	return nil
+}
+
+func audit_key(keyFile string) ([]byte, error) {
+	key, err := file_read(keyFile)
+	if err != nil {
+		return nil, errors.New("Unable to read the audit key file " + keyFile + "\n" + err.Error())
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, errors.New("The audit key file " + keyFile + " is empty.")
+	}
+	return key, nil
+}
+
+// The last entry in the audit file, or an empty entry if the file is empty.
+func audit_last(f *os.File) (auditEntry, error) {
+	var e auditEntry
+	info, err := f.Stat()
+	if err != nil {
+		return e, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return e, nil
+	}
+	start := size - int64(audit_entry_max)
+	if start < 0 {
+		start = 0
+	}
+	b := make([]byte, size-start)
+	_, err = f.ReadAt(b, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return e, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	}
+	err = json.Unmarshal(b, &e)
+	return e, err
+}
+
+// Encode an entry as a single line, adding its HMAC if there is a key.
+func audit_line(e auditEntry, key []byte, prev string) ([]byte, string, error) {
+	e.HMAC = ""
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	if key == nil {
+		return append(line, '\n'), "", nil
+	}
+	mac := audit_mac(key, prev, line)
+	line = append(line[:len(line)-1], []byte(`,"hmac":"`+mac+`"}`+"\n")...)
+	return line, mac, nil
+}
+
+func audit_mac(key []byte, prev string, line []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(prev))
+	m.Write(line)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Add an entry to the audit trail. The channel name must already be hidden.
+func (a *auditLog) Record(e auditEntry) {
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	a.Lock()
+	defer a.Unlock()
+	if a.f == nil {
+		if a.holding && len(a.held) < audit_held_max {
+			a.held = append(a.held, e)
+		}
+		return
+	}
+	a.write(e)
+}
+
+func (a *auditLog) write(e auditEntry) {
+	e.Seq = a.seq + 1
+	line, mac, err := audit_line(e, a.key, a.prev)
+	if err == nil {
+		_, err = a.f.Write(line)
+	}
+	if err != nil {
+		if !a.failing {
+			a.failing = true
+			a.hub.Log_error("Unable to write to the audit file " + a.f.Name() + ".\r\n" + err.Error())
+		}
+		return
+	}
+	a.seq = e.Seq
+	a.prev = mac
+	a.failing = false
+}
+
+func (a *auditLog) headWatch(done chan struct{}) {
+	ticker := time.NewTicker(audit_head_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			a.Lock()
+			file, key, seq, prev := "", a.key, a.seq, a.prev
+			if a.f != nil {
+				file = a.f.Name()
+			}
+			a.Unlock()
+			if file != "" {
+				a.headFlush(file, key, seq, prev)
+			}
+		}
+	}
+}
+
+// Write the head file, if entries have been added since it was last written.
+func (a *auditLog) headFlush(file string, key []byte, seq uint64, prev string) {
+	a.hl.Lock()
+	defer a.hl.Unlock()
+	if key == nil || seq <= a.headSeq {
+		return
+	}
+	err := audit_head_write(file, key, seq, prev)
+	if err != nil {
+		a.hub.Log_error("Unable to write the head of the audit file " + file + ".\r\n" + err.Error())
+		return
+	}
+	a.headSeq = seq
+}
+
+// The last entry written to an audit file, kept next to it.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	HMAC string `json:"hmac"`
+	// An HMAC of the sequence number and HMAC of the last entry, so the head can't be changed to match a file that has been cut short.
+	Check string `json:"check"`
+}
+
+func audit_head_file(file string) string {
+	return file + ".head"
+}
+
+func audit_head_mac(key []byte, seq uint64, mac string) string {
+	return audit_mac(key, "head", []byte(strconv.FormatUint(seq, 10)+" "+mac))
+}
+
+// Replace the head file, so it is never left half written.
+func audit_head_write(file string, key []byte, seq uint64, mac string) error {
+	b, err := json.Marshal(auditHead{Seq: seq, HMAC: mac, Check: audit_head_mac(key, seq, mac)})
+	if err != nil {
+		return err
+	}
+	head := audit_head_file(file)
+	err = os.WriteFile(head+".tmp", append(b, '\n'), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(head+".tmp", head)
+}
+
+// Read the head file of an audit file, checking that it was written with the key. The error wraps fs.ErrNotExist if there is no head file.
+func audit_head_read(file string, key []byte) (auditHead, error) {
+	var h auditHead
+	head := audit_head_file(file)
+	b, err := os.ReadFile(head)
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal(b, &h)
+	if err != nil {
+		return h, errors.New("The head file " + head + " is not valid JSON.\n" + err.Error())
+	}
+	if !hmac.Equal([]byte(h.Check), []byte(audit_head_mac(key, h.Seq, h.HMAC))) {
+		return h, errors.New("The head file " + head + " has been changed, or was written with a different key.")
+	}
+	return h, nil
+}
+
+// Check an entry of the audit file against its head, which can be behind the end of the file but never ahead of it.
+func audit_head_check(file string, h auditHead, seq uint64, mac string) error {
+	if h.Seq > seq {
+		return errors.New("The audit file ends with entry " + strconv.FormatUint(seq, 10) + ", but the head file " + audit_head_file(file) + " shows entry " + strconv.FormatUint(h.Seq, 10) + " was written. Entries have been removed from the end of the file.")
+	}
+	if h.Seq == seq && h.HMAC != mac {
+		return errors.New("Entry " + strconv.FormatUint(seq, 10) + " of the audit file doesn't match the head file " + audit_head_file(file) + ".")
+	}
+	return nil
+}
+
+func (a *auditLog) Close() {
+	a.close(false)
+}
+
+// Close the audit file, keeping the entries added until another file is opened, such as while a new process is started to take it over.
+func (a *auditLog) Hold() {
+	a.close(true)
+}
+
+func (a *auditLog) close(hold bool) {
+	a.Lock()
+	a.holding = hold && a.f != nil
+	if !a.holding {
+		a.held = nil
+	}
+	if a.f == nil {
+		a.Unlock()
+		return
+	}
+	if a.done != nil {
+		close(a.done)
+		a.done = nil
+	}
+	file, key, seq, prev := a.f.Name(), a.key, a.seq, a.prev
+	_ = a.f.Sync()
+	_ = a.f.Close()
+	a.f = nil
+	a.Unlock()
+	a.headFlush(file, key, seq, prev)
+}
+
+const auditVerifyUsage = `Usage: nvdaRemoteServer audit-verify [-key-file path] [-conf-file path] [file]
+
+Check that no entries in the audit file have been changed, removed, or reordered. With a key, the head file kept next to the audit file is checked as well, so entries removed from the end of the file are detected. If no file is given, the audit_file parameter will be read from the configuration file.
+`
+
+// Verify an audit file, returning the exit code.
+func AuditVerify(args []string) int {
+	var keyFile string
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	fs.Usage = func() {
+		fmt.Print(auditVerifyUsage + "\nParameters:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&keyFile, "key-file", DEFAULT_AUDIT_KEY_FILE, "Path to the file containing the key the audit file was written with. If this is empty, the audit_key_file parameter will be read from the configuration file.")
+	fs.StringVar(&confFile, "conf-file", DEFAULT_CONF_FILE, "Path to the configuration file the server is using.")
+	fs.BoolVar(&confRead, "conf-read", DEFAULT_CONF_READ, "Whether or not to read a configuration file to find the audit file and key file.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	file := fs.Arg(0)
+	// Reading the configuration file changes the working directory, so paths given here are resolved first.
+	if file != "" {
+		file = fullPath(file)
+	}
+	if keyFile != "" {
+		keyFile = fullPath(keyFile)
+	}
+	if file == "" || keyFile == "" {
+		c := cfg_default()
+		if c.Read() == nil {
+			if file == "" {
+				file = c.AuditFile
+			}
+			if keyFile == "" {
+				keyFile = c.AuditKeyFile
+			}
+		}
+	}
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "No audit file has been given, and none could be found in a configuration file.")
+		return 1
+	}
+	var key []byte
+	if keyFile != "" {
+		var err error
+		key, err = audit_key(keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	num, err := audit_verify(file, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if key == nil {
+		fmt.Println("Read " + strconv.Itoa(num) + " entries in sequence. No key was given, so the HMAC of each entry could not be checked.")
+	} else {
+		fmt.Println("Verified " + strconv.Itoa(num) + " entries.")
+	}
+	return 0
+}
+
+// Check every entry in the audit file, returning the number of entries.
+func audit_verify(file string, key []byte) (int, error) {
+	file = fullPath(file)
+	var h auditHead
+	if key != nil {
+		var err error
+		h, err = audit_head_read(file, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, errors.New("The head file " + audit_head_file(file) + " is missing, so entries removed from the end of the audit file can't be detected.")
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 4096), audit_entry_max)
+	var seq uint64
+	prev := ""
+	num := 0
+	for sc.Scan() {
+		num++
+		line := sc.Bytes()
+		var e auditEntry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return num - 1, errors.New("Entry " + strconv.Itoa(num) + " is not valid JSON.\n" + err.Error())
+		}
+		if e.Seq != seq+1 {
+			return num - 1, errors.New("Entry " + strconv.Itoa(num) + " has sequence number " + strconv.FormatUint(e.Seq, 10) + ", but " + strconv.FormatUint(seq+1, 10) + " was expected. Entries have been removed or reordered.")
+		}
+		seq = e.Seq
+		if key == nil {
+			continue
+		}
+		if e.HMAC == "" {
+			return num - 1, errors.New("Entry " + strconv.Itoa(num) + " has no HMAC.")
+		}
+		expected, _, err := audit_line(e, key, prev)
+		if err != nil {
+			return num - 1, err
+		}
+		if !hmac.Equal(bytes.TrimSuffix(expected, []byte("\n")), line) {
+			return num - 1, errors.New("Entry " + strconv.Itoa(num) + " has been changed, or was written with a different key.")
+		}
+		prev = e.HMAC
+		if e.Seq == h.Seq {
+			if err = audit_head_check(file, h, seq, prev); err != nil {
+				return num - 1, err
+			}
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return num, err
+	}
+	if key != nil {
+		err = audit_head_check(file, h, seq, prev)
+		if err != nil {
+			return num, err
+		}
+	}
+	return num, nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func audit_test_file(t *testing.T, entries int) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "audit.jsonl")
+	keyFile := filepath.Join(dir, "audit.key")
+	if err := os.WriteFile(keyFile, []byte("test key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{hub: defaultHub}
+	if err := a.Open(file, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		a.Record(auditEntry{Event: "test", Client: i + 1})
+	}
+	a.Close()
+	return file, keyFile
+}
+
+func audit_test_key(t *testing.T, keyFile string) []byte {
+	t.Helper()
+	key, err := audit_key(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAuditVerify(t *testing.T) {
+	file, keyFile := audit_test_file(t, 3)
+	num, err := audit_verify(file, audit_test_key(t, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 3 {
+		t.Fatalf("Expected 3 entries, got %d.", num)
+	}
+}
+
+func TestAuditTruncated(t *testing.T) {
+	file, keyFile := audit_test_file(t, 3)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remove the last entry, leaving a file that is still a valid chain.
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	b = b[:bytes.LastIndexByte(b, '\n')+1]
+	if err = os.WriteFile(file, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = audit_verify(file, audit_test_key(t, keyFile))
+	if err == nil || !strings.Contains(err.Error(), "removed from the end") {
+		t.Fatalf("Expected the removed entry to be detected, got %v", err)
+	}
+	// The server refuses to continue the file, rather than writing a head that hides the removed entry.
+	a := &auditLog{hub: defaultHub}
+	if err = a.Open(file, keyFile); err == nil {
+		a.Close()
+		t.Fatal("The audit file was opened after entries were removed from its end.")
+	}
+}
+
+func TestAuditHeadBehind(t *testing.T) {
+	file, keyFile := audit_test_file(t, 2)
+	key := audit_test_key(t, keyFile)
+	// A head naming an earlier entry must still match that entry.
+	if err := audit_head_write(file, key, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit_verify(file, key); err == nil {
+		t.Fatal("A head that doesn't match its entry wasn't detected.")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first auditEntry
+	if err = json.Unmarshal(b[:bytes.IndexByte(b, '\n')], &first); err != nil {
+		t.Fatal(err)
+	}
+	// A head behind the end of the file, as if the server stopped after adding an entry but before writing the head, is accepted.
+	if err = audit_head_write(file, key, first.Seq, first.HMAC); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = audit_verify(file, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditHold(t *testing.T) {
+	file, keyFile := audit_test_file(t, 1)
+	a := &auditLog{hub: defaultHub}
+	if err := a.Open(file, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	a.Hold()
+	// Entries added while the file is held go to the next file opened.
+	a.Record(auditEntry{Event: "held", Client: 2})
+	a.Record(auditEntry{Event: "held", Client: 3})
+	other := filepath.Join(filepath.Dir(file), "other.jsonl")
+	if err := a.Open(other, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	key := audit_test_key(t, keyFile)
+	for _, tc := range []struct {
+		file string
+		num  int
+	}{{file, 1}, {other, 2}} {
+		num, err := audit_verify(tc.file, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if num != tc.num {
+			t.Fatalf("Expected %d entries in %s, got %d.", tc.num, tc.file, num)
+		}
+	}
+	// Closing the file rather than holding it doesn't keep anything.
+	a.Close()
+	a.Record(auditEntry{Event: "dropped"})
+	if len(a.held) != 0 {
+		t.Fatal("An entry was kept after the audit file was closed.")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	authStageHandshake string = "handshake"
+	authStageCommand   string = "command"
+	authStageJoin      string = "join"
+)
+
+func (h *Hub) authTimeout() time.Duration {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return time.Duration(h.opts.AuthTimeout) * time.Second
+}
+
+// Disconnect the client if it hasn't joined a channel once the authentication timeout has passed.
+func (c *Client) authStart() {
+	timeout := c.s.hub.authTimeout()
+	if timeout <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.authTimer = time.AfterFunc(timeout, func() {
+		c.authExpired(timeout)
+	})
+}
+
+func (c *Client) authStop() {
+	c.Lock()
+	t := c.authTimer
+	c.authTimer = nil
+	c.Unlock()
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func (c *Client) authExpired(timeout time.Duration) {
+	c.Lock()
+	if c.c != nil || c.closed {
+		c.Unlock()
+		return
+	}
+	c.authTimer = nil
+	id := c.id
+	ip := c.ip
+	handshaken := c.handshaken
+	commands := c.commands
+	c.Unlock()
+	var stage, detail string
+	switch {
+	case !handshaken:
+		stage = authStageHandshake
+		detail = "The TLS handshake was not completed."
+	case commands == 0:
+		stage = authStageCommand
+		detail = "The TLS handshake was completed, but no commands were received."
+	default:
+		stage = authStageJoin
+		detail = "The TLS handshake was completed, and " + strconv.Itoa(commands) + " commands were received, but none of them joined a channel."
+	}
+	c.s.hub.stats.authTimeout(stage)
+	c.s.hub.Log(LOG_CONNECTION, "Client "+strconv.Itoa(id)+" from "+ip+" has not joined a channel within "+timeout.String()+". "+detail+" Closing connection.", log_fields("auth_timeout").Client(id).IP(ip))
+	c.Close()
+}
+
+// Record how long the client took to join its first channel.
+func (c *Client) authJoined() {
+	c.Lock()
+	t := c.authTimer
+	c.authTimer = nil
+	first := !c.joined
+	c.joined = true
+	id := c.id
+	ip := c.ip
+	elapsed := time.Since(c.connected)
+	c.Unlock()
+	if t != nil {
+		t.Stop()
+	}
+	if !first {
+		return
+	}
+	c.s.hub.stats.joinTime.observe(elapsed.Seconds())
+	c.s.hub.Log(LOG_DEBUG, "Client "+strconv.Itoa(id)+" has joined a channel "+elapsed.Round(time.Millisecond).String()+" after connecting.", log_fields("join_time").Client(id).IP(ip))
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ban_sweep_sec int = 60
+
+type banSettings struct {
+	failures int
+	window   time.Duration
+	banTime  time.Duration
+	maxTime  time.Duration
+}
+
+func (h *Hub) banSettings() banSettings {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return banSettings{
+		failures: h.opts.BanFailures,
+		window:   time.Duration(h.opts.BanWindow) * time.Second,
+		banTime:  time.Duration(h.opts.BanTime) * time.Second,
+		maxTime:  time.Duration(h.opts.BanMaxTime) * time.Second,
+	}
+}
+
+type banEntry struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Count  int       `json:"count"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Authorization failures and bans for every IP address, shared by all servers of a hub.
+type banList struct {
+	sync.Mutex
+	file     string
+	failures map[string][]time.Time
+	bans     map[string]*banEntry
+	// The hub whose settings and log are used.
+	hub *Hub
+	// Held while writing the file. Changes are numbered, so an older list never replaces a newer one.
+	wl      sync.Mutex
+	changes uint64
+	written uint64
+}
+
+// The ban list as it is to be written to the file.
+type banSave struct {
+	file   string
+	change uint64
+	data   []byte
+	err    error
+}
+
+var bans = newBanList()
+
+func newBanList() *banList {
+	return &banList{
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]*banEntry),
+	}
+}
+
+func (b *banList) Banned(ip string) bool {
+	b.Lock()
+	defer b.Unlock()
+	e, exists := b.bans[ip]
+	return exists && time.Now().Before(e.Until)
+}
+
+// Record an authorization failure, banning the address once it has failed too many times within the window.
+// Each ban of the same address lasts twice as long as the one before it.
+func (b *banList) Fail(ip, reason string) {
+	bs := b.hub.banSettings()
+	if bs.failures <= 0 || ip == "" {
+		return
+	}
+	now := time.Now()
+	b.Lock()
+	f := b.failures[ip][:0]
+	for _, t := range b.failures[ip] {
+		if now.Sub(t) < bs.window {
+			f = append(f, t)
+		}
+	}
+	f = append(f, now)
+	if len(f) < bs.failures {
+		b.failures[ip] = f
+		b.Unlock()
+		return
+	}
+	delete(b.failures, ip)
+	e, exists := b.bans[ip]
+	if !exists {
+		e = &banEntry{IP: ip}
+		b.bans[ip] = e
+	}
+	e.Count++
+	d := bs.banTime
+	for i := 1; i < e.Count && d < bs.maxTime; i++ {
+		d *= 2
+	}
+	if d > bs.maxTime {
+		d = bs.maxTime
+	}
+	e.Until = now.Add(d)
+	e.Reason = reason
+	count := e.Count
+	sv := b.save()
+	b.Unlock()
+	b.hub.stats.bans.Add(1)
+	b.hub.audit(auditEntry{Event: "banned", IP: ip, Reason: reason + " Banned for " + d.String() + "."})
+	b.hub.Log(LOG_INFO, "The IP address "+ip+" has been banned for "+d.String()+" after "+strconv.Itoa(len(f))+" authorization failures. This is ban number "+strconv.Itoa(count)+" for this address.\r\n"+reason)
+	b.write(sv)
+}
+
+func (b *banList) Unban(ip string) bool {
+	b.Lock()
+	delete(b.failures, ip)
+	_, exists := b.bans[ip]
+	if !exists {
+		b.Unlock()
+		return false
+	}
+	delete(b.bans, ip)
+	sv := b.save()
+	b.Unlock()
+	b.write(sv)
+	return true
+}
+
+// Remove every ban, returning the number of addresses that were banned.
+func (b *banList) Clear() int {
+	b.Lock()
+	now := time.Now()
+	num := 0
+	for _, e := range b.bans {
+		if now.Before(e.Until) {
+			num++
+		}
+	}
+	b.failures = make(map[string][]time.Time)
+	b.bans = make(map[string]*banEntry)
+	sv := b.save()
+	b.Unlock()
+	b.write(sv)
+	return num
+}
+
+// Snapshot of every active ban, sorted by when it expires.
+func (b *banList) List() []banEntry {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	list := make([]banEntry, 0, len(b.bans))
+	for _, e := range b.bans {
+		if now.Before(e.Until) {
+			list = append(list, *e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Until.Before(list[j].Until)
+	})
+	return list
+}
+
+// Load bans from a file, which will be rewritten whenever the bans change. A file that doesn't exist yet is not an error.
+func (b *banList) Load(file string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.file = file
+	if file == "" {
+		return nil
+	}
+	d, err := file_read(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []banEntry
+	err = json.Unmarshal(d, &list)
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].IP == "" {
+			continue
+		}
+		b.bans[list[i].IP] = &list[i]
+	}
+	return nil
+}
+
+// Encode the list to be written by write once the lock is released. Must be called with the lock held.
+func (b *banList) save() banSave {
+	if b.file == "" {
+		return banSave{}
+	}
+	b.changes++
+	list := make([]*banEntry, 0, len(b.bans))
+	for _, e := range b.bans {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IP < list[j].IP
+	})
+	d, err := json.MarshalIndent(list, "", "  ")
+	return banSave{file: b.file, change: b.changes, data: d, err: err}
+}
+
+// Must be called without the lock held.
+func (b *banList) write(sv banSave) {
+	if sv.file == "" {
+		return
+	}
+	if sv.err != nil {
+		b.hub.Log_error("Unable to encode the ban list.\r\n" + sv.err.Error())
+		return
+	}
+	b.wl.Lock()
+	defer b.wl.Unlock()
+	if sv.change <= b.written {
+		return
+	}
+	err := file_rewrite(sv.file, sv.data)
+	if err != nil {
+		b.hub.Log_error("Unable to save the ban list.\r\n" + err.Error())
+		return
+	}
+	b.written = sv.change
+}
+
+// Forget old failures and bans that expired long ago.
+func (b *banList) sweep() {
+	bs := b.hub.banSettings()
+	now := time.Now()
+	b.Lock()
+	for ip, f := range b.failures {
+		if len(f) == 0 || now.Sub(f[len(f)-1]) >= bs.window {
+			delete(b.failures, ip)
+		}
+	}
+	removed := false
+	for ip, e := range b.bans {
+		if now.Sub(e.Until) >= bs.maxTime {
+			delete(b.bans, ip)
+			removed = true
+		}
+	}
+	var sv banSave
+	if removed {
+		sv = b.save()
+	}
+	b.Unlock()
+	b.write(sv)
+}
+
+func (b *banList) watch(ctx context.Context) {
+	t := time.NewTicker(time.Duration(ban_sweep_sec) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			b.sweep()
+		}
+	}
+}
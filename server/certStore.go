@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const cert_watch_sec int = 30
+
+// Certificate served to new TLS handshakes. Replacing the certificate has no effect on connections that have already been established.
+type certStore struct {
+	sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	certInfo os.FileInfo
+	keyInfo  os.FileInfo
+	acme     *autocert.Manager
+	domain   string
+}
+
+var certs *certStore
+
+func newCertStore(cert *tls.Certificate) *certStore {
+	return &certStore{
+		cert: cert,
+	}
+}
+
+// Obtain certificates from an ACME certificate authority.
+func newCertStoreACME(m *autocert.Manager, domains DomainList) *certStore {
+	return &certStore{
+		acme:   m,
+		domain: domains[0],
+	}
+}
+
+// Load a certificate and key from files, which will be watched for changes.
+func newCertStoreFiles(certFile, keyFile string) (*certStore, error) {
+	cs := &certStore{}
+	err := cs.SetFiles(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cs.acme != nil {
+		if hello.ServerName == "" {
+			h := *hello
+			h.ServerName = cs.domain
+			hello = &h
+		}
+		return cs.acme.GetCertificate(hello)
+	}
+	cs.RLock()
+	defer cs.RUnlock()
+	if cs.cert == nil {
+		return nil, errors.New("No certificate has been loaded.")
+	}
+	return cs.cert, nil
+}
+
+func (cs *certStore) Files() (string, string) {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.certFile, cs.keyFile
+}
+
+// Switch to a different pair of files. If they can't be loaded, the previous certificate and files remain in use.
+func (cs *certStore) SetFiles(certFile, keyFile string) error {
+	ci, ki, cert, err := cert_load(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.certFile = certFile
+	cs.keyFile = keyFile
+	cs.certInfo = ci
+	cs.keyInfo = ki
+	cs.cert = cert
+	return nil
+}
+
+// Load the certificate files again. On failure, the previous certificate remains in use.
+func (cs *certStore) Reload() error {
+	cs.Lock()
+	certFile := cs.certFile
+	keyFile := cs.keyFile
+	cs.Unlock()
+	if certFile == "" || keyFile == "" {
+		return nil
+	}
+	ci, ki, cert, err := cert_load(certFile, keyFile)
+	cs.Lock()
+	defer cs.Unlock()
+	if ci != nil {
+		cs.certInfo = ci
+	}
+	if ki != nil {
+		cs.keyInfo = ki
+	}
+	if err != nil {
+		return err
+	}
+	cs.cert = cert
+	return nil
+}
+
+func (cs *certStore) changed() bool {
+	cs.RLock()
+	certFile := cs.certFile
+	keyFile := cs.keyFile
+	ci := cs.certInfo
+	ki := cs.keyInfo
+	cs.RUnlock()
+	if certFile == "" || keyFile == "" {
+		return false
+	}
+	return file_changed(certFile, ci) || file_changed(keyFile, ki)
+}
+
+func (cs *certStore) watch(ctx context.Context) {
+	t := time.NewTicker(time.Duration(cert_watch_sec) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !cs.changed() {
+				continue
+			}
+			Log(LOG_DEBUG, "The certificate or key file has changed.")
+			cs.reload_log()
+		}
+	}
+}
+
+func (cs *certStore) reload_log() {
+	certFile, keyFile := cs.Files()
+	if certFile == "" || keyFile == "" {
+		return
+	}
+	err := cs.Reload()
+	if err != nil {
+		Log_error("Unable to reload the certificate file " + certFile + " and key file " + keyFile + ". The previous certificate will remain in use.\r\n" + err.Error())
+		return
+	}
+	Log(LOG_INFO, "Certificate reloaded from "+certFile+cert_expiry(cs))
+}
+
+func cert_expiry(cs *certStore) string {
+	cs.RLock()
+	cert := cs.cert
+	cs.RUnlock()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return "."
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "."
+	}
+	return ". It expires on " + leaf.NotAfter.Format(time.RFC1123) + "."
+}
+
+func cert_load(certFile, keyFile string) (os.FileInfo, os.FileInfo, *tls.Certificate, error) {
+	ci, cerr := os.Stat(certFile)
+	ki, kerr := os.Stat(keyFile)
+	if cerr != nil {
+		return ci, ki, nil, cerr
+	}
+	if kerr != nil {
+		return ci, ki, nil, kerr
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ci, ki, nil, err
+	}
+	return ci, ki, &cert, nil
+}
+
+func file_changed(file string, old os.FileInfo) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	if old == nil {
+		return true
+	}
+	return !info.ModTime().Equal(old.ModTime()) || info.Size() != old.Size()
+}
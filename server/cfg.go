@@ -12,12 +12,59 @@ type Cfg struct {
 	PidFile           string      `json:"pid_file"`
 	LogFile           string      `json:"log_file"`
 	LogLevel          int         `json:"log_level"`
+	LogFormat         string      `json:"log_format"`
+	LogMaxSize        int         `json:"log_max_size"`
+	LogMaxAge         int         `json:"log_max_age"`
+	LogMaxFiles       int         `json:"log_max_files"`
+	LogCompress       bool        `json:"log_compress"`
+	LogSink           string      `json:"log_sink"`
+	LogSinkCAFile     string      `json:"log_sink_ca_file"`
+	LogSecrets        bool        `json:"log_secrets"`
+	LogRedact         string      `json:"log_redact"`
 	Addresses         AddressList `json:"addresses"`
 	Cert              string      `json:"cert_file"`
 	Key               string      `json:"key_file"`
 	Motd              string      `json:"motd"`
 	MotdAlwaysDisplay bool        `json:"motd_always_display"`
 	SendOrigin        bool        `json:"send_origin"`
+	AdminSocket       string      `json:"admin_socket"`
+	WebSocketAddress  string      `json:"websocket_address"`
+	WebSocketPath     string      `json:"websocket_path"`
+	MetricsAddress    string      `json:"metrics_address"`
+	AcmeDomains       DomainList  `json:"acme_domains"`
+	AcmeEmail         string      `json:"acme_email"`
+	AcmeDirectory     string      `json:"acme_directory"`
+	AcmeCacheDir      string      `json:"acme_cache_dir"`
+	AcmeHTTPAddress   string      `json:"acme_http_address"`
+	AcmeCAFile        string      `json:"acme_ca_file"`
+	MaxConnsPerIP     int         `json:"max_connections_per_ip"`
+	ConnsPerMinute    int         `json:"connections_per_minute"`
+	CmdsPerMinute     int         `json:"commands_per_minute"`
+	RatelimitExempt   CIDRList    `json:"ratelimit_exempt"`
+	Allow             CIDRList    `json:"allow"`
+	Deny              CIDRList    `json:"deny"`
+	DenyLogLevel      int         `json:"deny_log_level"`
+	ProxyProtocol     AddressList `json:"proxy_protocol"`
+	ProxyTrust        CIDRList    `json:"proxy_trust"`
+	BanFailures       int         `json:"ban_failures"`
+	BanWindow         int         `json:"ban_window"`
+	BanTime           int         `json:"ban_time"`
+	BanMaxTime        int         `json:"ban_max_time"`
+	BanFile           string      `json:"ban_file"`
+	AuditFile         string      `json:"audit_file"`
+	AuditKeyFile      string      `json:"audit_key_file"`
+	RecordDir         string      `json:"record_dir"`
+	RecordChannels    NameList    `json:"record_channels"`
+	MaxAuthMsgSize    int         `json:"max_auth_message_size"`
+	MaxMsgSize        int         `json:"max_message_size"`
+	AuthTimeout       int         `json:"auth_timeout"`
+	UpgradeTimeout    int         `json:"upgrade_timeout"`
+	DrainTime         int         `json:"drain_time"`
+	IdleTimeoutMaster int         `json:"idle_timeout_master"`
+	IdleTimeoutSlave  int         `json:"idle_timeout_slave"`
+	SendQueueDepth    int         `json:"send_queue_depth"`
+	SendQueuePolicy   string      `json:"send_queue_policy"`
+	SendQueueTimeout  int         `json:"send_queue_timeout"`
 	ll                []int
 	ls                [][]interface{}
 	le                []bool
@@ -29,12 +76,59 @@ func cfg_default() *Cfg {
 		PidFile:           DEFAULT_PID_FILE,
 		LogFile:           DEFAULT_LOG_FILE,
 		LogLevel:          DEFAULT_LOG_LEVEL,
+		LogFormat:         DEFAULT_LOG_FORMAT,
+		LogMaxSize:        DEFAULT_LOG_MAX_SIZE,
+		LogMaxAge:         DEFAULT_LOG_MAX_AGE,
+		LogMaxFiles:       DEFAULT_LOG_MAX_FILES,
+		LogCompress:       DEFAULT_LOG_COMPRESS,
+		LogSink:           DEFAULT_LOG_SINK,
+		LogSinkCAFile:     DEFAULT_LOG_SINK_CA_FILE,
+		LogSecrets:        DEFAULT_LOG_SECRETS,
+		LogRedact:         DEFAULT_LOG_REDACT,
 		Addresses:         AddressList{DEFAULT_ADDRESS},
 		Cert:              DEFAULT_CERT_FILE,
 		Key:               DEFAULT_KEY_FILE,
 		Motd:              DEFAULT_MOTD,
 		MotdAlwaysDisplay: DEFAULT_MOTD_ALWAYS_DISPLAY,
 		SendOrigin:        DEFAULT_SEND_ORIGIN,
+		AdminSocket:       DEFAULT_ADMIN_SOCKET,
+		WebSocketAddress:  DEFAULT_WEBSOCKET_ADDRESS,
+		WebSocketPath:     DEFAULT_WEBSOCKET_PATH,
+		MetricsAddress:    DEFAULT_METRICS_ADDRESS,
+		AcmeDomains:       DomainList{},
+		AcmeEmail:         DEFAULT_ACME_EMAIL,
+		AcmeDirectory:     DEFAULT_ACME_DIRECTORY,
+		AcmeCacheDir:      DEFAULT_ACME_CACHE_DIR,
+		AcmeHTTPAddress:   DEFAULT_ACME_HTTP_ADDRESS,
+		AcmeCAFile:        DEFAULT_ACME_CA_FILE,
+		MaxConnsPerIP:     DEFAULT_MAX_CONNS_PER_IP,
+		ConnsPerMinute:    DEFAULT_CONNS_PER_MINUTE,
+		CmdsPerMinute:     DEFAULT_CMDS_PER_MINUTE,
+		RatelimitExempt:   CIDRList{},
+		Allow:             CIDRList{},
+		Deny:              CIDRList{},
+		DenyLogLevel:      DEFAULT_DENY_LOG_LEVEL,
+		ProxyProtocol:     AddressList{},
+		ProxyTrust:        CIDRList{},
+		BanFailures:       DEFAULT_BAN_FAILURES,
+		BanWindow:         DEFAULT_BAN_WINDOW,
+		BanTime:           DEFAULT_BAN_TIME,
+		BanMaxTime:        DEFAULT_BAN_MAX_TIME,
+		BanFile:           DEFAULT_BAN_FILE,
+		AuditFile:         DEFAULT_AUDIT_FILE,
+		AuditKeyFile:      DEFAULT_AUDIT_KEY_FILE,
+		RecordDir:         DEFAULT_RECORD_DIR,
+		RecordChannels:    NameList{},
+		MaxAuthMsgSize:    DEFAULT_MAX_AUTH_MESSAGE_SIZE,
+		MaxMsgSize:        DEFAULT_MAX_MESSAGE_SIZE,
+		AuthTimeout:       DEFAULT_AUTH_TIMEOUT,
+		UpgradeTimeout:    DEFAULT_UPGRADE_TIMEOUT,
+		DrainTime:         DEFAULT_DRAIN_TIME,
+		IdleTimeoutMaster: DEFAULT_IDLE_TIMEOUT_MASTER,
+		IdleTimeoutSlave:  DEFAULT_IDLE_TIMEOUT_SLAVE,
+		SendQueueDepth:    DEFAULT_SEND_QUEUE_DEPTH,
+		SendQueuePolicy:   DEFAULT_SEND_QUEUE_POLICY,
+		SendQueueTimeout:  DEFAULT_SEND_QUEUE_TIMEOUT,
 		ll:                make([]int, 0),
 		ls:                make([][]interface{}, 0),
 		le:                make([]bool, 0),
@@ -51,6 +145,33 @@ func (c *Cfg) IsDefault() bool {
 	if !default_log_level(c.LogLevel) {
 		return false
 	}
+	if !default_log_format(c.LogFormat) {
+		return false
+	}
+	if !default_log_max_size(c.LogMaxSize) {
+		return false
+	}
+	if !default_log_max_age(c.LogMaxAge) {
+		return false
+	}
+	if !default_log_max_files(c.LogMaxFiles) {
+		return false
+	}
+	if !default_log_compress(c.LogCompress) {
+		return false
+	}
+	if !default_log_sink(c.LogSink) {
+		return false
+	}
+	if !default_log_sink_ca_file(c.LogSinkCAFile) {
+		return false
+	}
+	if !default_log_secrets(c.LogSecrets) {
+		return false
+	}
+	if !default_log_redact(c.LogRedact) {
+		return false
+	}
 	if !default_addresses(c.Addresses) {
 		return false
 	}
@@ -69,6 +190,120 @@ func (c *Cfg) IsDefault() bool {
 	if !default_send_origin(c.SendOrigin) {
 		return false
 	}
+	if !default_admin_socket(c.AdminSocket) {
+		return false
+	}
+	if !default_websocket_address(c.WebSocketAddress) {
+		return false
+	}
+	if !default_websocket_path(c.WebSocketPath) {
+		return false
+	}
+	if !default_metrics_address(c.MetricsAddress) {
+		return false
+	}
+	if !default_acme_domains(c.AcmeDomains) {
+		return false
+	}
+	if !default_acme_email(c.AcmeEmail) {
+		return false
+	}
+	if !default_acme_directory(c.AcmeDirectory) {
+		return false
+	}
+	if !default_acme_cache_dir(c.AcmeCacheDir) {
+		return false
+	}
+	if !default_acme_http_address(c.AcmeHTTPAddress) {
+		return false
+	}
+	if !default_acme_ca_file(c.AcmeCAFile) {
+		return false
+	}
+	if !default_max_conns_per_ip(c.MaxConnsPerIP) {
+		return false
+	}
+	if !default_conns_per_minute(c.ConnsPerMinute) {
+		return false
+	}
+	if !default_cmds_per_minute(c.CmdsPerMinute) {
+		return false
+	}
+	if !default_cidr_list(c.RatelimitExempt) {
+		return false
+	}
+	if !default_cidr_list(c.Allow) {
+		return false
+	}
+	if !default_cidr_list(c.Deny) {
+		return false
+	}
+	if !default_deny_log_level(c.DenyLogLevel) {
+		return false
+	}
+	if !default_proxy_protocol(c.ProxyProtocol) {
+		return false
+	}
+	if !default_cidr_list(c.ProxyTrust) {
+		return false
+	}
+	if !default_ban_failures(c.BanFailures) {
+		return false
+	}
+	if !default_ban_window(c.BanWindow) {
+		return false
+	}
+	if !default_ban_time(c.BanTime) {
+		return false
+	}
+	if !default_ban_max_time(c.BanMaxTime) {
+		return false
+	}
+	if !default_ban_file(c.BanFile) {
+		return false
+	}
+	if !default_audit_file(c.AuditFile) {
+		return false
+	}
+	if !default_audit_key_file(c.AuditKeyFile) {
+		return false
+	}
+	if !default_record_dir(c.RecordDir) {
+		return false
+	}
+	if !default_record_channels(c.RecordChannels) {
+		return false
+	}
+	if !default_max_auth_message_size(c.MaxAuthMsgSize) {
+		return false
+	}
+	if !default_max_message_size(c.MaxMsgSize) {
+		return false
+	}
+	if !default_auth_timeout(c.AuthTimeout) {
+		return false
+	}
+	if !default_upgrade_timeout(c.UpgradeTimeout) {
+		return false
+	}
+	if !default_drain_time(c.DrainTime) {
+		return false
+	}
+	if !default_idle_timeout_master(c.IdleTimeoutMaster) {
+		return false
+	}
+	if !default_idle_timeout_slave(c.IdleTimeoutSlave) {
+		return false
+	}
+	if !default_send_queue_depth(c.SendQueueDepth) {
+		return false
+	}
+	if !default_send_queue_policy(c.SendQueuePolicy) {
+		return false
+	}
+	if !default_send_queue_timeout(c.SendQueueTimeout) {
+		return false
+	}
 	return true
 }
 
@@ -225,12 +460,94 @@ func (c *Cfg) CmdGet() {
 	c.PidFile = pidfile
 	c.LogFile = logfile
 	c.LogLevel = loglevel
+	c.LogFormat = logFormat
+	c.LogMaxSize = logMaxSize
+	c.LogMaxAge = logMaxAge
+	c.LogMaxFiles = logMaxFiles
+	c.LogCompress = logCompress
+	c.LogSink = logSinkTarget
+	c.LogSinkCAFile = logSinkCAFile
+	c.LogSecrets = logSecrets
+	c.LogRedact = logRedact
 	c.Addresses = addresses
 	c.Cert = cert
 	c.Key = key
 	c.Motd = motd
 	c.MotdAlwaysDisplay = motdAlwaysDisplay
 	c.SendOrigin = sendOrigin
+	c.AdminSocket = adminSocket
+	c.WebSocketAddress = websocketAddress
+	c.WebSocketPath = websocketPath
+	c.MetricsAddress = metricsAddress
+	c.AcmeDomains = acmeDomains
+	c.AcmeEmail = acmeEmail
+	c.AcmeDirectory = acmeDirectory
+	c.AcmeCacheDir = acmeCacheDir
+	c.AcmeHTTPAddress = acmeHTTPAddress
+	c.AcmeCAFile = acmeCAFile
+	c.MaxConnsPerIP = maxConnsPerIP
+	c.ConnsPerMinute = connsPerMinute
+	c.CmdsPerMinute = cmdsPerMinute
+	c.RatelimitExempt = ratelimitExempt
+	c.Allow = allowList
+	c.Deny = denyList
+	c.DenyLogLevel = denyLogLevel
+	c.ProxyProtocol = proxyAddresses
+	c.ProxyTrust = proxyTrust
+	c.BanFailures = banFailures
+	c.BanWindow = banWindow
+	c.BanTime = banTime
+	c.BanMaxTime = banMaxTime
+	c.BanFile = banFile
+	c.AuditFile = auditFile
+	c.AuditKeyFile = auditKeyFile
+	c.RecordDir = recordDir
+	c.RecordChannels = recordChannels
+	c.MaxAuthMsgSize = maxAuthMessageSize
+	c.MaxMsgSize = maxMessageSize
+	c.AuthTimeout = authTimeout
+	c.UpgradeTimeout = upgradeTimeout
+	c.DrainTime = drainTime
+	c.IdleTimeoutMaster = idleTimeoutMaster
+	c.IdleTimeoutSlave = idleTimeoutSlave
+	c.SendQueueDepth = sendQueueDepth
+	c.SendQueuePolicy = sendQueuePolicy
+	c.SendQueueTimeout = sendQueueTimeout
+}
+
+// The settings for a hub given by this configuration, before any checks are applied.
+func (c *Cfg) Options() Options {
+	return Options{
+		LogLevel:          c.LogLevel,
+		LogSecrets:        c.LogSecrets,
+		LogRedact:         c.LogRedact,
+		Motd:              c.Motd,
+		MotdAlwaysDisplay: c.MotdAlwaysDisplay,
+		SendOrigin:        c.SendOrigin,
+		MaxConnsPerIP:     c.MaxConnsPerIP,
+		ConnsPerMinute:    c.ConnsPerMinute,
+		CmdsPerMinute:     c.CmdsPerMinute,
+		RatelimitExempt:   c.RatelimitExempt,
+		Allow:             c.Allow,
+		Deny:              c.Deny,
+		DenyLogLevel:      c.DenyLogLevel,
+		ProxyTrust:        c.ProxyTrust,
+		BanFailures:       c.BanFailures,
+		BanWindow:         c.BanWindow,
+		BanTime:           c.BanTime,
+		BanMaxTime:        c.BanMaxTime,
+		RecordDir:         c.RecordDir,
+		RecordChannels:    c.RecordChannels,
+		MaxAuthMsgSize:    c.MaxAuthMsgSize,
+		MaxMsgSize:        c.MaxMsgSize,
+		AuthTimeout:       c.AuthTimeout,
+		DrainTime:         c.DrainTime,
+		IdleTimeoutMaster: c.IdleTimeoutMaster,
+		IdleTimeoutSlave:  c.IdleTimeoutSlave,
+		SendQueueDepth:    c.SendQueueDepth,
+		SendQueuePolicy:   c.SendQueuePolicy,
+		SendQueueTimeout:  c.SendQueueTimeout,
+	}
 }
 
 func (c *Cfg) CmdSet() {
@@ -243,6 +560,33 @@ func (c *Cfg) CmdSet() {
 	if !default_log_level(c.LogLevel) && default_log_level(loglevel) {
 		loglevel = c.LogLevel
 	}
+	if !default_log_format(c.LogFormat) && default_log_format(logFormat) {
+		logFormat = c.LogFormat
+	}
+	if !default_log_max_size(c.LogMaxSize) && default_log_max_size(logMaxSize) {
+		logMaxSize = c.LogMaxSize
+	}
+	if !default_log_max_age(c.LogMaxAge) && default_log_max_age(logMaxAge) {
+		logMaxAge = c.LogMaxAge
+	}
+	if !default_log_max_files(c.LogMaxFiles) && default_log_max_files(logMaxFiles) {
+		logMaxFiles = c.LogMaxFiles
+	}
+	if !default_log_compress(c.LogCompress) && default_log_compress(logCompress) {
+		logCompress = c.LogCompress
+	}
+	if !default_log_sink(c.LogSink) && default_log_sink(logSinkTarget) {
+		logSinkTarget = c.LogSink
+	}
+	if !default_log_sink_ca_file(c.LogSinkCAFile) && default_log_sink_ca_file(logSinkCAFile) {
+		logSinkCAFile = c.LogSinkCAFile
+	}
+	if !default_log_secrets(c.LogSecrets) && default_log_secrets(logSecrets) {
+		logSecrets = c.LogSecrets
+	}
+	if !default_log_redact(c.LogRedact) && default_log_redact(logRedact) {
+		logRedact = c.LogRedact
+	}
 	if !default_addresses(c.Addresses) && default_addresses(addresses) {
 		addresses = c.Addresses
 	}
@@ -261,6 +605,120 @@ func (c *Cfg) CmdSet() {
 	if !default_send_origin(c.SendOrigin) && default_send_origin(sendOrigin) {
 		sendOrigin = c.SendOrigin
 	}
+	if !default_admin_socket(c.AdminSocket) && default_admin_socket(adminSocket) {
+		adminSocket = c.AdminSocket
+	}
+	if !default_websocket_address(c.WebSocketAddress) && default_websocket_address(websocketAddress) {
+		websocketAddress = c.WebSocketAddress
+	}
+	if !default_websocket_path(c.WebSocketPath) && default_websocket_path(websocketPath) {
+		websocketPath = c.WebSocketPath
+	}
+	if !default_metrics_address(c.MetricsAddress) && default_metrics_address(metricsAddress) {
+		metricsAddress = c.MetricsAddress
+	}
+	if !default_acme_domains(c.AcmeDomains) && default_acme_domains(acmeDomains) {
+		acmeDomains = c.AcmeDomains
+	}
+	if !default_acme_email(c.AcmeEmail) && default_acme_email(acmeEmail) {
+		acmeEmail = c.AcmeEmail
+	}
+	if !default_acme_directory(c.AcmeDirectory) && default_acme_directory(acmeDirectory) {
+		acmeDirectory = c.AcmeDirectory
+	}
+	if !default_acme_cache_dir(c.AcmeCacheDir) && default_acme_cache_dir(acmeCacheDir) {
+		acmeCacheDir = c.AcmeCacheDir
+	}
+	if !default_acme_http_address(c.AcmeHTTPAddress) && default_acme_http_address(acmeHTTPAddress) {
+		acmeHTTPAddress = c.AcmeHTTPAddress
+	}
+	if !default_acme_ca_file(c.AcmeCAFile) && default_acme_ca_file(acmeCAFile) {
+		acmeCAFile = c.AcmeCAFile
+	}
+	if !default_max_conns_per_ip(c.MaxConnsPerIP) && default_max_conns_per_ip(maxConnsPerIP) {
+		maxConnsPerIP = c.MaxConnsPerIP
+	}
+	if !default_conns_per_minute(c.ConnsPerMinute) && default_conns_per_minute(connsPerMinute) {
+		connsPerMinute = c.ConnsPerMinute
+	}
+	if !default_cmds_per_minute(c.CmdsPerMinute) && default_cmds_per_minute(cmdsPerMinute) {
+		cmdsPerMinute = c.CmdsPerMinute
+	}
+	if !default_cidr_list(c.RatelimitExempt) && default_cidr_list(ratelimitExempt) {
+		ratelimitExempt = c.RatelimitExempt
+	}
+	if !default_cidr_list(c.Allow) && default_cidr_list(allowList) {
+		allowList = c.Allow
+	}
+	if !default_cidr_list(c.Deny) && default_cidr_list(denyList) {
+		denyList = c.Deny
+	}
+	if !default_deny_log_level(c.DenyLogLevel) && default_deny_log_level(denyLogLevel) {
+		denyLogLevel = c.DenyLogLevel
+	}
+	if !default_proxy_protocol(c.ProxyProtocol) && default_proxy_protocol(proxyAddresses) {
+		proxyAddresses = c.ProxyProtocol
+	}
+	if !default_cidr_list(c.ProxyTrust) && default_cidr_list(proxyTrust) {
+		proxyTrust = c.ProxyTrust
+	}
+	if !default_ban_failures(c.BanFailures) && default_ban_failures(banFailures) {
+		banFailures = c.BanFailures
+	}
+	if !default_ban_window(c.BanWindow) && default_ban_window(banWindow) {
+		banWindow = c.BanWindow
+	}
+	if !default_ban_time(c.BanTime) && default_ban_time(banTime) {
+		banTime = c.BanTime
+	}
+	if !default_ban_max_time(c.BanMaxTime) && default_ban_max_time(banMaxTime) {
+		banMaxTime = c.BanMaxTime
+	}
+	if !default_ban_file(c.BanFile) && default_ban_file(banFile) {
+		banFile = c.BanFile
+	}
+	if !default_audit_file(c.AuditFile) && default_audit_file(auditFile) {
+		auditFile = c.AuditFile
+	}
+	if !default_audit_key_file(c.AuditKeyFile) && default_audit_key_file(auditKeyFile) {
+		auditKeyFile = c.AuditKeyFile
+	}
+	if !default_record_dir(c.RecordDir) && default_record_dir(recordDir) {
+		recordDir = c.RecordDir
+	}
+	if !default_record_channels(c.RecordChannels) && default_record_channels(recordChannels) {
+		recordChannels = c.RecordChannels
+	}
+	if !default_max_auth_message_size(c.MaxAuthMsgSize) && default_max_auth_message_size(maxAuthMessageSize) {
+		maxAuthMessageSize = c.MaxAuthMsgSize
+	}
+	if !default_max_message_size(c.MaxMsgSize) && default_max_message_size(maxMessageSize) {
+		maxMessageSize = c.MaxMsgSize
+	}
+	if !default_auth_timeout(c.AuthTimeout) && default_auth_timeout(authTimeout) {
+		authTimeout = c.AuthTimeout
+	}
+	if !default_upgrade_timeout(c.UpgradeTimeout) && default_upgrade_timeout(upgradeTimeout) {
+		upgradeTimeout = c.UpgradeTimeout
+	}
+	if !default_drain_time(c.DrainTime) && default_drain_time(drainTime) {
+		drainTime = c.DrainTime
+	}
+	if !default_idle_timeout_master(c.IdleTimeoutMaster) && default_idle_timeout_master(idleTimeoutMaster) {
+		idleTimeoutMaster = c.IdleTimeoutMaster
+	}
+	if !default_idle_timeout_slave(c.IdleTimeoutSlave) && default_idle_timeout_slave(idleTimeoutSlave) {
+		idleTimeoutSlave = c.IdleTimeoutSlave
+	}
+	if !default_send_queue_depth(c.SendQueueDepth) && default_send_queue_depth(sendQueueDepth) {
+		sendQueueDepth = c.SendQueueDepth
+	}
+	if !default_send_queue_policy(c.SendQueuePolicy) && default_send_queue_policy(sendQueuePolicy) {
+		sendQueuePolicy = c.SendQueuePolicy
+	}
+	if !default_send_queue_timeout(c.SendQueueTimeout) && default_send_queue_timeout(sendQueueTimeout) {
+		sendQueueTimeout = c.SendQueueTimeout
+	}
 }
 
 func (c *Cfg) Cwd(d string) {
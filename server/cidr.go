@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+type CIDRList []string
+
+func (l *CIDRList) String() string {
+	if len(*l) == 0 {
+		return ""
+	}
+	return strings.Join(*l, "\n")
+}
+
+func (l *CIDRList) Set(v string) error {
+	_, err := cidr_parse(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// Parse a network in CIDR notation. A single IP address is treated as a network containing only that address.
+func cidr_parse(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, errors.New("The network " + v + " is invalid. It must be an IP address, or a network in CIDR notation, such as 192.0.2.0/24.")
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, errors.New("The network " + v + " is invalid. It must be an IP address, or a network in CIDR notation, such as 192.0.2.0/24.")
+	}
+	return n, nil
+}
+
+type netList []*net.IPNet
+
+// Parse every network in a list, logging and skipping any that are invalid.
+func cidr_check(h *Hub, name string, l CIDRList) netList {
+	nets := make(netList, 0, len(l))
+	for _, v := range l {
+		n, err := cidr_parse(v)
+		if err != nil {
+			h.Log_error("Invalid entry in " + name + " will be ignored.\r\n" + err.Error())
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func (l netList) Contains(ip string) bool {
+	if len(l) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range l {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,14 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"strconv"
 	"sync"
 	"time"
+
+	"golang.org/x/crypto/acme"
 )
 
+var errACMEChallenge = errors.New("ACME TLS-ALPN-01 challenge.")
+
+var errMessageTooLarge = errors.New("Message too large.")
+
 var ping_msg = []byte(`{"type":"ping"}`)
 
 const ping_sec int = 120
@@ -33,7 +40,14 @@ type Client struct {
 	t                 *time.Ticker
 	s                 *Server
 	closed            bool
-	sd                chan []byte
+	sq                *sendQueue
+	connected         time.Time
+	handshaken        bool
+	commands          int
+	joined            bool
+	authTimer         *time.Timer
+	lastRecv          time.Time
+	probed            bool
 }
 
 func (c *Client) ClearChannel() {
@@ -43,9 +57,19 @@ func (c *Client) ClearChannel() {
 }
 
 func (c *Client) SetChannel(clientChannel *ClientChannel) {
-	defer c.Unlock()
 	c.Lock()
 	c.c = clientChannel
+	c.Unlock()
+	if clientChannel != nil {
+		c.authJoined()
+	}
+}
+
+// Count a command received before joining a channel.
+func (c *Client) CommandReceived() {
+	defer c.Unlock()
+	c.Lock()
+	c.commands++
 }
 
 func (c *Client) GetChannel() *ClientChannel {
@@ -115,25 +139,33 @@ func (c *Client) listen() {
 	reader := bufio.NewReader(c.conn)
 	EndMessage := c.messageTerminator
 	idstr := strconv.Itoa(c.id)
+	id := c.id
+	ip := c.ip
 	c.Unlock()
 	// Send data to client.
-	c.sd = make(chan []byte, 100)
 	go func() {
-		for b := range c.sd {
+		for {
+			b, ok := c.sq.pop(c.ctx.Done())
+			if !ok {
+				return
+			}
 			if len(b) == 0 {
 				c.Close()
 				return
 			}
-			Log(LOG_PROTOCOL, "Data sent to client "+idstr+"\r\n"+string(b))
+			if c.s.hub.logEnabled(LOG_PROTOCOL) {
+				c.s.hub.Log(LOG_PROTOCOL, "Data sent to client "+idstr+"\r\n"+c.protocol(b), log_fields("data_sent").Client(id).IP(ip))
+			}
 			_ = c.conn.SetWriteDeadline(time.Now().Add(time.Duration(write_sec) * time.Second))
-			num, err := c.conn.Write(append(b, EndMessage))
+			// The same message can be queued for many clients, so it is copied rather than appended to in place.
+			num, err := c.conn.Write(append(b[:len(b):len(b)], EndMessage))
 			if err != nil {
-				Log(LOG_DEBUG, "Error sending message to client "+idstr+".\r\n"+err.Error()+"\r\nClosing connection.")
+				c.s.hub.Log(LOG_DEBUG, "Error sending message to client "+idstr+".\r\n"+err.Error()+"\r\nClosing connection.", log_fields("send_error").Client(id).IP(ip))
 				c.Close()
 				return
 			}
 			if num < len(b)+1 {
-				Log(LOG_DEBUG, "Error sending data to client "+idstr+". There were "+strconv.Itoa(num)+" bytes sent to the client, but the client should have been sent "+strconv.Itoa(len(b)+1)+" bytes. Closing connection.")
+				c.s.hub.Log(LOG_DEBUG, "Error sending data to client "+idstr+". There were", num, "bytes sent to the client, but the client should have been sent", len(b)+1, "bytes. Closing connection.", log_fields("send_error").Client(id).IP(ip))
 				c.Close()
 				return
 			}
@@ -145,16 +177,17 @@ func (c *Client) listen() {
 		for {
 			select {
 			case <-c.ctx.Done():
-				msl.Lock()
+				c.authStop()
+				c.s.hub.msl.Lock()
 				c.s.Lock()
 				c.t.Stop()
 				c.Lock()
 				c.conn.Close()
 				c.closed = true
-				close(c.sd)
+				c.sq.close()
 				c.Unlock()
 				c.s.Unlock()
-				msl.Unlock()
+				c.s.hub.msl.Unlock()
 				return
 			case <-c.t.C:
 				c.Send(ping_msg)
@@ -162,49 +195,206 @@ func (c *Client) listen() {
 		}
 	}()
 	defer c.s.Done()
-	defer RemoveClient(c)
+	defer c.s.limits.disconnect(c.ip)
+	defer c.s.hub.RemoveClient(c)
 	defer c.Close()
+	c.authStart()
+	err := c.handshake()
+	if errors.Is(err, errACMEChallenge) {
+		c.s.hub.Log(LOG_DEBUG, "Client", id, "has completed an ACME TLS-ALPN-01 challenge. Closing connection.", log_fields("acme_challenge").Client(id).IP(ip))
+		return
+	}
+	if err != nil && c.ctx.Err() != nil {
+		// Closed during the handshake, such as by the authentication timeout.
+		return
+	}
+	if err != nil {
+		c.s.hub.stats.handshakeErrors.Add(1)
+		c.s.hub.Log(LOG_DEBUG, "TLS handshake with client", id, "failed.\r\n"+err.Error()+"\r\nClosing connection.", log_fields("handshake_error").Client(id).IP(ip))
+		return
+	}
 	for {
-		message, err := reader.ReadBytes(EndMessage)
+		limit := c.s.hub.messageSize(c.GetChannel() != nil)
+		message, err := read_message(reader, EndMessage, limit)
+		if len(message) > 0 {
+			c.Received()
+		}
+		if errors.Is(err, errMessageTooLarge) {
+			c.tooLarge(limit)
+			return
+		}
 		if err != nil {
-			msl.Lock()
-			if !stoppingServers {
+			c.s.hub.msl.Lock()
+			if !c.s.hub.stopping {
 				c.Lock()
 				if !c.closed {
 					if !errors.Is(err, io.EOF) {
-						Log(LOG_DEBUG, "Error receiving message from client "+idstr+".\r\n"+err.Error()+"\r\nClosing connection.")
+						c.s.hub.Log(LOG_DEBUG, "Error receiving message from client "+idstr+".\r\n"+err.Error()+"\r\nClosing connection.", log_fields("receive_error").Client(id).IP(ip))
 					}
 				}
 				c.Unlock()
 			}
-			msl.Unlock()
+			c.s.hub.msl.Unlock()
 			return
 		}
 		if len(message) == 1 {
-			Log(LOG_DEBUG, "Received empty message from client "+idstr)
+			c.s.hub.Log(LOG_DEBUG, "Received empty message from client", id, log_fields("empty_message").Client(id).IP(ip))
 			continue
 		}
 		message = bytes.TrimRight(message, string(EndMessage))
-		Log(LOG_PROTOCOL, "Data received from client "+idstr+"\r\n"+string(message))
-		MessageReceived(c, message)
+		if c.s.hub.logEnabled(LOG_PROTOCOL) {
+			c.s.hub.Log(LOG_PROTOCOL, "Data received from client "+idstr+"\r\n"+c.protocol(message), log_fields("data_received").Client(id).IP(ip))
+		}
+		c.s.hub.MessageReceived(c, message)
+	}
+}
+
+// Read up to and including the terminator, failing once more than limit bytes arrive without it.
+func read_message(r *bufio.Reader, term byte, limit int) ([]byte, error) {
+	var message []byte
+	for {
+		if r.Buffered() == 0 {
+			_, err := r.Peek(1)
+			if err != nil {
+				return message, err
+			}
+		}
+		buf, _ := r.Peek(r.Buffered())
+		n := len(buf)
+		i := bytes.IndexByte(buf, term)
+		if i >= 0 {
+			n = i + 1
+		}
+		if limit > 0 && len(message)+n > limit+1 {
+			return nil, errMessageTooLarge
+		}
+		message = append(message, buf[:n]...)
+		_, _ = r.Discard(n)
+		if i >= 0 {
+			return message, nil
+		}
+	}
+}
+
+func (c *Client) tooLarge(limit int) {
+	id := c.GetID()
+	c.s.hub.stats.tooLarge.Add(1)
+	inChannel := c.GetChannel() != nil
+	c.s.hub.Log(LOG_CONNECTION, "Client", id, "from", c.GetIP(), "has sent a message larger than the limit of", limit, "bytes. Closing connection.", c.fields("message_too_large"))
+	if !inChannel {
+		c.s.hub.bans.Fail(c.GetIP(), "Sent a message larger than "+strconv.Itoa(limit)+" bytes before joining a channel.")
+	}
+	enc, encerr := Encode(Data{
+		Type:  "error",
+		Error: "message_too_large",
+	})
+	if encerr != nil {
+		c.s.hub.Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(id)+"\r\n"+encerr.Error(), c.fields("encode_error"))
+		return
+	}
+	c.sendNow(enc)
+}
+
+// Write a message immediately instead of queueing it, for an error sent just before the connection is closed.
+func (c *Client) sendNow(b []byte) {
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		c.s.hub.stats.droppedSends.Add(1)
+		return
+	}
+	if c.s.hub.logEnabled(LOG_PROTOCOL) {
+		c.s.hub.Log(LOG_PROTOCOL, "Data sent to client "+strconv.Itoa(c.GetID())+"\r\n"+c.protocol(b), c.fields("data_sent"))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(time.Duration(write_sec) * time.Second))
+	_, _ = c.conn.Write(append(b, c.messageTerminator))
+}
+
+// Complete the TLS handshake before any data is read, so failures can be told apart from protocol errors.
+func (c *Client) handshake() error {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		c.Lock()
+		c.handshaken = true
+		c.Unlock()
+		return nil
+	}
+	_ = tc.SetDeadline(time.Now().Add(time.Duration(ping_sec) * time.Second))
+	err := tc.Handshake()
+	_ = tc.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if tc.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		return errACMEChallenge
+	}
+	c.Lock()
+	c.handshaken = true
+	c.Unlock()
+	return nil
+}
+
+// Protocol data prepared for logging, with the key and password of the client's channel hidden. The client must not be locked.
+func (c *Client) protocol(b []byte) string {
+	var secrets []string
+	cc := c.GetChannel()
+	if cc != nil {
+		secrets = cc.Secrets()
 	}
+	return c.s.hub.redact().protocol(b, secrets...)
+}
+
+// Structured log fields identifying this client. The channel is left out, since messages can be sent while the channel is locked.
+func (c *Client) fields(event string) logFields {
+	c.Lock()
+	defer c.Unlock()
+	return log_fields(event).Client(c.id).IP(c.ip)
 }
 
 // Send bytes to client.
 func (c *Client) Send(b []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			c.Close()
-		}
-	}()
+	c.enqueue(b, true)
+}
+
+// Send bytes relayed from another client. Unlike messages from the server, these can be dropped when the client can't keep up.
+func (c *Client) Relay(b []byte) {
+	c.enqueue(b, false)
+}
+
+func (c *Client) enqueue(b []byte, control bool) {
 	c.Lock()
 	if c.closed {
 		c.Unlock()
+		c.s.hub.stats.droppedSends.Add(1)
 		return
 	}
+	q := c.sq
+	id := c.id
 	c.Unlock()
 	if len(b) == 0 {
 		return
 	}
-	c.sd <- b
+	dropped, first, keep := q.push(queuedMessage{data: b, control: control}, c.ctx.Done())
+	if dropped > 0 {
+		c.s.hub.stats.queueDropped.Add(uint64(dropped))
+	}
+	if !keep {
+		c.s.hub.stats.queueDisconnects.Add(1)
+		reason := "is full"
+		waiting := q.depth
+		switch q.policy {
+		case queuePolicyBlock:
+			reason = "has been full for longer than " + q.timeout.String()
+		case queuePolicyDropOldest:
+			reason = "is full of messages from the server"
+			waiting = q.depth * queue_overflow
+		}
+		c.s.hub.Log(LOG_CONNECTION, "The send queue for client", id, reason+", with", waiting, "messages waiting. Closing connection.", c.fields("send_queue_full"))
+		c.Close()
+		return
+	}
+	if first {
+		c.s.hub.Log(LOG_CONNECTION, "The send queue for client", id, "is full, with", q.depth, "messages waiting. Messages relayed to this client are being dropped until it catches up.", c.fields("send_queue_dropping"))
+	}
 }
@@ -20,6 +20,9 @@ type ClientChannel struct {
 	ClientsAll    map[int]*Client
 	ClientsMaster map[int]*Client
 	ClientsSlave  map[int]*Client
+	// Set when the channel is created, if it is being recorded.
+	rec *recorder
+	hub *Hub
 }
 
 func (c *ClientChannel) Lmotd(ctype, name, password string) string {
@@ -30,7 +33,8 @@ func (c *ClientChannel) Lmotd(ctype, name, password string) string {
 		if c.password != "" {
 			msg += " unless they authenticate"
 			if password == c.password {
-				msg += " with the password " + c.password
+				// The password itself isn't repeated, since anyone reading the message of the day could use it.
+				msg += " with the password you joined with."
 			} else {
 				msg += "."
 			}
@@ -42,7 +46,7 @@ func (c *ClientChannel) Lmotd(ctype, name, password string) string {
 			msg += "You won't be able to control any computers connected to this channel."
 		}
 		if c.password == password && c.password != "" {
-			msg += "You are authorized to control any computer connected to this channel. Authorized with password " + c.password
+			msg += "You are authorized to control any computer connected to this channel."
 		}
 	}
 	if !c.locked {
@@ -53,6 +57,17 @@ func (c *ClientChannel) Lmotd(ctype, name, password string) string {
 }
 
 func (c *ClientChannel) Add(client *Client, password string) {
+	// Audited once the channel is unlocked, so writing the audit file or ban list doesn't hold up the channel.
+	var entries []auditEntry
+	failed := ""
+	defer func() {
+		for _, e := range entries {
+			c.hub.audit(e)
+		}
+		if failed != "" {
+			c.hub.bans.Fail(client.GetIP(), failed)
+		}
+	}()
 	defer c.Unlock()
 	c.Lock()
 	auth := false
@@ -63,6 +78,10 @@ func (c *ClientChannel) Add(client *Client, password string) {
 		if password == c.password && c.password != "" {
 			client.SetAuthorized(true)
 			auth = true
+		} else if password != "" {
+			c.hub.Log(LOG_DEBUG, "Client", id, "has given the wrong password for channel", c.hub.secret(c.name), log_fields("wrong_password").Client(id).IP(client.GetIP()).Channel(c.name))
+			entries = append(entries, auditEntry{Event: "wrong_password", Client: id, IP: client.GetIP(), Channel: c.name, ConnectionType: connection})
+			failed = "Wrong password given for the locked channel " + c.hub.secret(c.name)
 		}
 	} else {
 		client.SetAuthorized(true)
@@ -103,7 +122,7 @@ func (c *ClientChannel) Add(client *Client, password string) {
 	if encerr == nil {
 		c.SendAll(enc, client)
 	} else {
-		Log(LOG_DEBUG, "Error encoding JSON for client "+strconv.Itoa(id)+" while trying to add them to channel "+c.name+"\r\n"+encerr.Error())
+		c.hub.Log(LOG_DEBUG, "Error encoding JSON for client", id, "while trying to add them to channel", c.hub.secret(c.name)+"\r\n"+encerr.Error(), log_fields("encode_error").Client(id).IP(client.GetIP()).Channel(c.name))
 	}
 
 	scdb.Type = "channel_joined"
@@ -140,6 +159,14 @@ func (c *ClientChannel) Add(client *Client, password string) {
 	if encerr == nil {
 		client.Send(enc)
 	}
+	if c.rec != nil {
+		if lmotd == "" {
+			lmotd = record_motd
+		} else {
+			lmotd = record_motd + "\n" + lmotd
+		}
+	}
+	motd, motdAlwaysDisplay := c.hub.motd()
 	if motd != "" || lmotd != "" {
 		mdb := Data{
 			Type:              "motd",
@@ -159,7 +186,7 @@ func (c *ClientChannel) Add(client *Client, password string) {
 			client.Send(enc)
 		}
 	}
-	logstr := "Client " + strconv.Itoa(id) + " has joined channel " + c.name
+	logstr := "Client " + strconv.Itoa(id) + " has joined channel " + c.hub.secret(c.name)
 	if connection != "" {
 		logstr += " as a " + connection + ". "
 		if auth {
@@ -168,15 +195,17 @@ func (c *ClientChannel) Add(client *Client, password string) {
 			logstr += "This client is not authorized to control other computers"
 		}
 	}
-	Log(LOG_CHANNEL, logstr+".")
+	c.hub.Log(LOG_CHANNEL, logstr+".", log_fields("client_joined").Client(id).IP(client.GetIP()).Channel(c.name))
+	entries = append(entries, auditEntry{Event: "client_joined", Client: id, IP: client.GetIP(), Channel: c.name, ConnectionType: connection, Authorized: audit_bool(auth)})
 }
 
 func (c *ClientChannel) Remove(client *Client) {
+	id := client.GetID()
+	connection := client.GetConnectionType()
 	defer c.EndIfEmpty()
+	defer c.hub.audit(auditEntry{Event: "client_left", Client: id, IP: client.GetIP(), Channel: c.name, ConnectionType: connection})
 	defer c.Unlock()
 	c.Lock()
-	id := client.GetID()
-	connection := client.GetConnectionType()
 	switch connection {
 	case connTypeMaster:
 		_, exists := c.ClientsMaster[id]
@@ -209,7 +238,7 @@ func (c *ClientChannel) Remove(client *Client) {
 	if encerr == nil {
 		c.SendAll(enc, client)
 	}
-	Log(LOG_CHANNEL, "Client "+strconv.Itoa(id)+" has left channel "+c.name)
+	c.hub.Log(LOG_CHANNEL, "Client", id, "has left channel", c.hub.secret(c.name), log_fields("client_left").Client(id).IP(client.GetIP()).Channel(c.name))
 }
 
 func (c *ClientChannel) EndIfEmpty() bool {
@@ -224,12 +253,8 @@ func (c *ClientChannel) EndIfEmpty() bool {
 }
 
 func (c *ClientChannel) Quit() {
-	defer c.Unlock()
 	c.Lock()
-	if c.ClientsAll == nil {
-		RemoveChannel(c.name)
-		return
-	}
+	c.rec.Close()
 	for id, client := range c.ClientsAll {
 		delete(c.ClientsMaster, id)
 		delete(c.ClientsSlave, id)
@@ -238,18 +263,26 @@ func (c *ClientChannel) Quit() {
 	c.ClientsAll = nil
 	c.ClientsMaster = nil
 	c.ClientsSlave = nil
-	RemoveChannel(c.name)
+	c.Unlock()
+	c.hub.RemoveChannel(c.name)
 }
 
 func (c *ClientChannel) SendAll(msg []byte, client *Client) {
 	if len(c.ClientsAll) == 0 {
 		return
 	}
-	for _, sc := range c.ClientsAll {
+	var to []int
+	for id, sc := range c.ClientsAll {
 		if client != nil && client == sc {
 			continue
 		}
 		sc.Send(msg)
+		if c.rec != nil {
+			to = append(to, id)
+		}
+	}
+	if c.rec != nil {
+		c.rec.Record(0, "", to, msg)
 	}
 }
 
@@ -258,20 +291,32 @@ func (c *ClientChannel) SendOthers(msg []byte, client *Client) {
 		return
 	}
 	connection := client.GetConnectionType()
-	var clients map[int]*Client
+	var list map[int]*Client
 	auth := client.GetAuthorized()
 	c.Lock()
 	switch connection {
 	case connTypeMaster:
-		clients = c.ClientsSlave
+		list = c.ClientsSlave
 	case connTypeSlave:
-		clients = c.ClientsMaster
+		list = c.ClientsMaster
 	default:
-		clients = c.ClientsAll
+		list = c.ClientsAll
+	}
+	// Copied, since clients can join or leave while the message is being relayed.
+	clients := make(map[int]*Client, len(list))
+	for id, cl := range list {
+		clients[id] = cl
 	}
 	c.Unlock()
+	var to []int
+	if c.rec != nil {
+		defer func() {
+			c.rec.Record(client.GetID(), connection, to, msg)
+		}()
+	}
 	if len(clients) == 0 {
 		if connection == connTypeMaster {
+			c.hub.stats.notConnected.Add(1)
 			client.Send([]byte("{\"type\":\"nvda_not_connected\"}"))
 		}
 		return
@@ -279,11 +324,16 @@ func (c *ClientChannel) SendOthers(msg []byte, client *Client) {
 	if connection == connTypeMaster && !auth {
 		return
 	}
-	for _, sc := range clients {
+	direction := relayDirection(connection)
+	for id, sc := range clients {
 		if sc == client {
 			continue
 		}
-		sc.Send(msg)
+		sc.Relay(msg)
+		c.hub.stats.relayed(direction, len(msg))
+		if c.rec != nil {
+			to = append(to, id)
+		}
 	}
 }
 
@@ -293,7 +343,28 @@ func (c *ClientChannel) Name() string {
 	return c.name
 }
 
+// The channel key and password, to be hidden when logging.
+func (c *ClientChannel) Secrets() []string {
+	c.Lock()
+	defer c.Unlock()
+	return []string{c.name, c.password}
+}
+
+func (c *ClientChannel) Clients() []*Client {
+	c.Lock()
+	defer c.Unlock()
+	cl := make([]*Client, 0, len(c.ClientsAll))
+	for _, client := range c.ClientsAll {
+		cl = append(cl, client)
+	}
+	return cl
+}
+
 func NewClientChannel(name, password string, locked bool, client *Client) *ClientChannel {
+	return newClientChannel(name, password, locked, client, client.s.hub.recordStart(name, password))
+}
+
+func newClientChannel(name, password string, locked bool, client *Client, rec *recorder) *ClientChannel {
 	c := &ClientChannel{
 		name:          name,
 		locked:        locked,
@@ -301,6 +372,8 @@ func NewClientChannel(name, password string, locked bool, client *Client) *Clien
 		ClientsAll:    make(map[int]*Client),
 		ClientsMaster: make(map[int]*Client),
 		ClientsSlave:  make(map[int]*Client),
+		rec:           rec,
+		hub:           client.s.hub,
 	}
 	c.Add(client, password)
 	return c
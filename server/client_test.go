@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Never sends a terminator, counting how much has been read from it.
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'a'
+	}
+	r.read += len(b)
+	return len(b), nil
+}
+
+func TestReadMessage(t *testing.T) {
+	limit := 64
+	for _, tc := range []struct {
+		name  string
+		input string
+		limit int
+		// The messages that are read before an error, or before the input ends.
+		messages []string
+		err      error
+	}{
+		{"at the limit", strings.Repeat("a", limit) + "\n", limit, []string{strings.Repeat("a", limit) + "\n"}, io.EOF},
+		{"one over the limit", strings.Repeat("a", limit+1) + "\n", limit, nil, errMessageTooLarge},
+		{"over the limit after a message", "a\n" + strings.Repeat("a", limit+1) + "\n", limit, []string{"a\n"}, errMessageTooLarge},
+		{"several messages", "a\nbb\n\n", limit, []string{"a\n", "bb\n", "\n"}, io.EOF},
+		{"unlimited", strings.Repeat("a", 4096) + "\n", 0, []string{strings.Repeat("a", 4096) + "\n"}, io.EOF},
+		{"no terminator", "abc", limit, nil, io.EOF},
+	} {
+		// Messages are split across reads, both one byte at a time and by a buffer smaller than the limit.
+		for _, r := range []io.Reader{iotest.OneByteReader(strings.NewReader(tc.input)), strings.NewReader(tc.input)} {
+			br := bufio.NewReaderSize(r, 16)
+			var messages []string
+			var err error
+			for {
+				var m []byte
+				m, err = read_message(br, '\n', tc.limit)
+				if err != nil {
+					break
+				}
+				messages = append(messages, string(m))
+			}
+			if err != tc.err {
+				t.Fatalf("%s: got the error %v, expected %v", tc.name, err, tc.err)
+			}
+			if strings.Join(messages, "|") != strings.Join(tc.messages, "|") {
+				t.Fatalf("%s: expected the messages %q, got %q.", tc.name, tc.messages, messages)
+			}
+		}
+	}
+}
+
+// A client that never sends a terminator is stopped once it passes the limit, rather than read into memory forever.
+func TestReadMessageBounded(t *testing.T) {
+	limit := 1 << 16
+	r := &endlessReader{}
+	br := bufio.NewReaderSize(r, 4096)
+	m, err := read_message(br, '\n', limit)
+	if err != errMessageTooLarge {
+		t.Fatalf("Expected the message to be too large: %v", err)
+	}
+	if m != nil {
+		t.Fatalf("Expected no message, got %d bytes.", len(m))
+	}
+	if r.read > limit+2*4096 {
+		t.Fatalf("Read %d bytes for a limit of %d.", r.read, limit)
+	}
+}
@@ -31,6 +31,20 @@ func cmd_exec(c *Client, db *Data) error {
 
 func init() {
 	cmd_add("join", func(c *Client, db *Data) {
+		if c.s.hub.draining.Load() {
+			c.s.hub.Log(LOG_DEBUG, "Client", c.GetID(), "has tried to join a channel while the server is shutting down.", c.fields("join_refused"))
+			enc, encerr := Encode(Data{
+				Type:              "motd",
+				Motd:              "This server is shutting down, and isn't accepting anyone into a channel. Please reconnect later.",
+				MotdAlwaysDisplay: true,
+			})
+			if encerr == nil {
+				c.Send(enc)
+			} else {
+				c.s.hub.Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID())+"\r\n"+encerr.Error(), c.fields("encode_error"))
+			}
+			return
+		}
 		if c.GetChannel() != nil {
 			enc, encerr := Encode(Data{
 				Type:  "error",
@@ -40,7 +54,7 @@ func init() {
 				c.Send(enc)
 				return
 			} else {
-				Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID())+"\r\n"+encerr.Error())
+				c.s.hub.Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID())+"\r\n"+encerr.Error(), c.fields("encode_error"))
 				return
 			}
 		}
@@ -56,23 +70,23 @@ func init() {
 				c.Send(enc)
 				return
 			} else {
-				Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID())+"\r\n"+encerr.Error())
+				c.s.hub.Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID())+"\r\n"+encerr.Error(), c.fields("encode_error"))
 				return
 			}
 		}
 
 		c.SetConnectionType(db.ConnectionType)
-		cc := FindChannel(db.Channel)
+		cc := c.s.hub.FindChannel(db.Channel)
 		if cc != nil {
 			cc.Add(c, password)
 			return
 		}
-		AddChannel(db.Channel, password, locked, c)
+		c.s.hub.AddChannel(db.Channel, password, locked, c)
 	})
 
 	cmd_add("protocol_version", func(c *Client, db *Data) {
 		if db.Version <= 0 {
-			Log(LOG_DEBUG, "Client "+strconv.Itoa(c.GetID())+" has tried to register an invalid version number.")
+			c.s.hub.Log(LOG_DEBUG, "Client", c.GetID(), "has tried to register an invalid version number.", c.fields("invalid_version"))
 			enc, encerr := Encode(Data{
 				Type:  "error",
 				Error: "invalid_parameters",
@@ -81,26 +95,26 @@ func init() {
 				c.Send(enc)
 				return
 			} else {
-				Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID()))
+				c.s.hub.Log(LOG_DEBUG, "JSON encoding error for client", c.GetID(), c.fields("encode_error"))
 				return
 			}
 		}
 		c.SetVersion(db.Version)
-		Log(LOG_DEBUG, "Client "+strconv.Itoa(c.GetID())+" has set protocol version "+strconv.Itoa(db.Version)+".")
+		c.s.hub.Log(LOG_DEBUG, "Client", c.GetID(), "has set protocol version", strconv.Itoa(db.Version)+".", c.fields("protocol_version"))
 	})
 
 	cmd_add("generate_key", func(c *Client, db *Data) {
-		key := gen_key()
+		key := gen_key(c.s.hub)
 		enc, encerr := Encode(Data{
 			Type: "generate_key",
 			Key:  key,
 		})
 		if encerr != nil {
-			Log(LOG_DEBUG, "JSON encoding error for client "+strconv.Itoa(c.GetID()))
+			c.s.hub.Log(LOG_DEBUG, "JSON encoding error for client", c.GetID(), c.fields("encode_error"))
 			return
 		}
 		c.Send(enc)
-		Log(LOG_DEBUG, "Client "+strconv.Itoa(c.GetID())+" has generated a key: "+key)
+		c.s.hub.Log(LOG_DEBUG, "Client", c.GetID(), "has generated a key:", c.s.hub.secret(key), c.fields("key_generated"))
 		time.Sleep(time.Second)
 		c.Close()
 	})
@@ -6,6 +6,10 @@ import (
 	"flag"
 	"os"
 	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var confFile string
@@ -29,18 +33,112 @@ var logfile string
 
 var loglevel int
 
+var logFormat string
+
+var (
+	logMaxSize  int
+	logMaxAge   int
+	logMaxFiles int
+	logCompress bool
+)
+
+var (
+	logSinkTarget string
+	logSinkCAFile string
+)
+
+var (
+	logSecrets bool
+	logRedact  string
+)
+
 var motd string
 
 var motdAlwaysDisplay bool
 
 var sendOrigin bool
 
+var adminSocket string
+
+var (
+	websocketAddress string
+	websocketPath    string
+)
+
+var metricsAddress string
+
+var (
+	acmeDomains     DomainList
+	acmeEmail       string
+	acmeDirectory   string
+	acmeCacheDir    string
+	acmeHTTPAddress string
+	acmeCAFile      string
+	acmeManager     *autocert.Manager
+)
+
+var (
+	maxConnsPerIP   int
+	connsPerMinute  int
+	cmdsPerMinute   int
+	ratelimitExempt CIDRList
+)
+
+var (
+	proxyAddresses AddressList
+	proxyTrust     CIDRList
+)
+
+var (
+	allowList    CIDRList
+	denyList     CIDRList
+	denyLogLevel int
+)
+
+var (
+	banFailures int
+	banWindow   int
+	banTime     int
+	banMaxTime  int
+	banFile     string
+)
+
+var (
+	auditFile    string
+	auditKeyFile string
+)
+
+var (
+	recordDir      string
+	recordChannels NameList
+)
+
+var (
+	maxAuthMessageSize int
+	maxMessageSize     int
+)
+
+var authTimeout int
+
+var upgradeTimeout int
+
+var drainTime int
+
+var (
+	idleTimeoutMaster int
+	idleTimeoutSlave  int
+)
+
+var (
+	sendQueueDepth   int
+	sendQueuePolicy  string
+	sendQueueTimeout int
+)
+
 var createDir bool
 
 var Launch bool
 
-var Servers []*Server
-
 var (
 	PID     int
 	PID_STR string
@@ -66,21 +164,85 @@ func Configure() error {
 	flag.StringVar(&key, "key-file", DEFAULT_KEY_FILE, "SSL key to use for the server's TLS connection, must point to an existing file. If this is empty, the server will automatically generate its own self-signed certificate.")
 	flag.StringVar(&gencertfile, "gen-cert-file", DEFAULT_GEN_CERT_FILE, "Generate a certificate file from the self-generated, self-signed SSL certificate. This file will only be created if you aren't loading your own certificate key files. The file will encode the key and certificate, packaging them both in a single .pem file.")
 
+	flag.Var(&acmeDomains, "acme-domain", "Domain to automatically obtain a certificate for from an ACME certificate authority, such as Letsencrypt. You can declare this parameter more than once for multiple domains. If this is set, the cert-file and key-file parameters will be ignored.")
+	flag.StringVar(&acmeEmail, "acme-email", DEFAULT_ACME_EMAIL, "Contact email address to register with the ACME certificate authority. This is optional.")
+	flag.StringVar(&acmeDirectory, "acme-directory", DEFAULT_ACME_DIRECTORY, "Directory URL of the ACME certificate authority.")
+	flag.StringVar(&acmeCacheDir, "acme-cache-dir", DEFAULT_ACME_CACHE_DIR, "Directory where certificates and the account key obtained from the ACME certificate authority are stored.")
+	flag.StringVar(&acmeHTTPAddress, "acme-http-address", DEFAULT_ACME_HTTP_ADDRESS, "Address in the format ip:port to answer ACME HTTP-01 challenges on, such as \":80\". If this is empty, only TLS-ALPN-01 challenges will be answered, which requires the server to be reachable on port 443.")
+	flag.StringVar(&acmeCAFile, "acme-ca-file", DEFAULT_ACME_CA_FILE, "Certificate authority file to trust when connecting to the ACME directory, such as the root certificate of a test server. If this is empty, the system certificate authorities are used.")
+
 	flag.StringVar(&pidfile, "pid-file", DEFAULT_PID_FILE, "Create a PID file when the server has successfully started.")
 
 	flag.Var(&addresses, "address", "Address the server will listen on in the format ip:port, such as \"0.0.0.0:6837\", \":6837\", \"[::]:6837\". The port must be between 1 and 65536. You can declare this parameter more than once for multiple listen addresses.")
 
 	flag.IntVar(&loglevel, "log-level", DEFAULT_LOG_LEVEL, "Choose what log level you wish to use. Any value below -1 will be ignored.")
+	flag.StringVar(&logFormat, "log-format", DEFAULT_LOG_FORMAT, "Format of log messages. \""+LOG_FORMAT_TEXT+"\" writes messages as plain text, and \""+LOG_FORMAT_JSON+"\" writes one JSON object per line, with the time, level, event, client ID, IP address, and channel of each message as separate fields.")
+	flag.IntVar(&logMaxSize, "log-max-size", DEFAULT_LOG_MAX_SIZE, "Size in megabytes the log file can grow to before it is rotated, renaming it with the current time added to its name and starting a new one. A value of 0 disables rotating the log file by size.")
+	flag.IntVar(&logMaxAge, "log-max-age", DEFAULT_LOG_MAX_AGE, "Number of seconds after the log file was opened before it is rotated, such as 86400 to rotate it daily. A value of 0 disables rotating the log file by age.")
+	flag.IntVar(&logMaxFiles, "log-max-files", DEFAULT_LOG_MAX_FILES, "Number of rotated log files to keep. Older ones are removed. A value of 0 keeps every rotated log file.")
+	flag.BoolVar(&logCompress, "log-compress", DEFAULT_LOG_COMPRESS, "Compress rotated log files with gzip.")
+	flag.StringVar(&logSinkTarget, "log-sink", DEFAULT_LOG_SINK, "Where to send log entries in addition to the console and log file. \""+LOG_SINK_JOURNALD+"\" sends them to the systemd journal instead of standard output. A URL such as \"udp://localhost:514\", \"tcp://localhost:601\", or \"tls://localhost:6514\" sends them to a syslog server in the RFC 5424 format. If this is empty, log entries aren't sent anywhere else.")
+	flag.StringVar(&logSinkCAFile, "log-sink-ca-file", DEFAULT_LOG_SINK_CA_FILE, "Certificate authority file to trust when connecting to a syslog server over TLS. If this is empty, the system certificate authorities are used.")
+	flag.BoolVar(&logSecrets, "log-secrets", DEFAULT_LOG_SECRETS, "Log channel keys, channel passwords, and generated keys as they are. By default, they are hidden in all log messages. Only use this for debugging.")
+	flag.StringVar(&logRedact, "log-redact", DEFAULT_LOG_REDACT, "How secrets are hidden in log messages. \""+REDACT_MASK+"\" replaces them with the same text, and \""+REDACT_HASH+"\" replaces them with a hash, so messages about the same channel can be matched up. Hashes change every time the server is started.")
 	flag.StringVar(&logfile, "log-file", DEFAULT_LOG_FILE, "Choose what log file you wish to use in addition to logging output to the console. If the file can't be created or open for writing, the program will fall back to console logging only.")
 
+	flag.IntVar(&maxConnsPerIP, "max-connections-per-ip", DEFAULT_MAX_CONNS_PER_IP, "Maximum number of connections a single IP address can have open to each address the server is listening on. A value of 0 disables this limit.")
+	flag.IntVar(&connsPerMinute, "connections-per-minute", DEFAULT_CONNS_PER_MINUTE, "Maximum number of new connections a single IP address can make to each address the server is listening on per minute. A value of 0 disables this limit.")
+	flag.IntVar(&cmdsPerMinute, "commands-per-minute", DEFAULT_CMDS_PER_MINUTE, "Maximum number of commands a single IP address can send per minute before joining a channel, such as join or generate_key. A value of 0 disables this limit.")
+	flag.Var(&ratelimitExempt, "ratelimit-exempt", "An IP address, or network in CIDR notation such as \"192.0.2.0/24\", that is exempt from all rate limits. You can declare this parameter more than once for multiple networks.")
+
+	flag.Var(&allowList, "allow", "An IP address, or network in CIDR notation such as \"192.0.2.0/24\", that is allowed to connect. If any are given, connections from every other address will be refused. You can declare this parameter more than once for multiple networks.")
+	flag.Var(&denyList, "deny", "An IP address, or network in CIDR notation such as \"192.0.2.0/24\", that will be refused a connection. This takes priority over the allow parameter. You can declare this parameter more than once for multiple networks.")
+	flag.IntVar(&denyLogLevel, "deny-log-level", DEFAULT_DENY_LOG_LEVEL, "The log level at which connections refused by the allow or deny parameters are logged.")
+
+	flag.Var(&proxyAddresses, "proxy-protocol", "Address given by the address or websocket-address parameter on which every connection must start with a PROXY protocol version 1 or 2 header, such as one sent by HAProxy or a load balancer. The address of the client in the header is used in place of the address of the proxy. You can declare this parameter more than once for multiple addresses.")
+	flag.Var(&proxyTrust, "proxy-trust", "An IP address, or network in CIDR notation such as \"192.0.2.0/24\", of a proxy trusted to send PROXY protocol headers. Connections from any other address to an address given by the proxy-protocol parameter will be refused. You can declare this parameter more than once for multiple networks.")
+
+	flag.IntVar(&maxAuthMessageSize, "max-auth-message-size", DEFAULT_MAX_AUTH_MESSAGE_SIZE, "Maximum size in bytes of a message from a client that hasn't joined a channel yet. A client sending a larger message will be disconnected. A value of 0 disables this limit.")
+	flag.IntVar(&maxMessageSize, "max-message-size", DEFAULT_MAX_MESSAGE_SIZE, "Maximum size in bytes of a message from a client that has joined a channel. A client sending a larger message will be disconnected. A value of 0 disables this limit.")
+
+	flag.IntVar(&upgradeTimeout, "upgrade-timeout", DEFAULT_UPGRADE_TIMEOUT, "Number of seconds the previous process keeps serving the clients connected to it after an upgrade, before disconnecting them. A value of 0 keeps serving them until they have all disconnected.")
+
+	flag.IntVar(&drainTime, "drain-time", DEFAULT_DRAIN_TIME, "Number of seconds to keep serving connected clients after a signal to shut down is received, while telling them the server is shutting down. The server shuts down sooner if every channel is empty, or a second signal is received. A value of 0 shuts down immediately.")
+
+	flag.IntVar(&authTimeout, "auth-timeout", DEFAULT_AUTH_TIMEOUT, "Number of seconds a client has to complete the TLS handshake and join a channel after connecting, before it is disconnected. A value of 0 disables this timeout.")
+
+	flag.IntVar(&idleTimeoutMaster, "idle-timeout-master", DEFAULT_IDLE_TIMEOUT_MASTER, "Number of seconds a master in a channel can go without sending any data before it is removed from the channel and disconnected. A value of 0 disables this timeout.")
+	flag.IntVar(&idleTimeoutSlave, "idle-timeout-slave", DEFAULT_IDLE_TIMEOUT_SLAVE, "Number of seconds a slave in a channel can go without sending any data before it is removed from the channel and disconnected. A value of 0 disables this timeout.")
+
+	flag.IntVar(&sendQueueDepth, "send-queue-depth", DEFAULT_SEND_QUEUE_DEPTH, "Number of messages that can be waiting to be sent to each client.")
+	flag.StringVar(&sendQueuePolicy, "send-queue-policy", DEFAULT_SEND_QUEUE_POLICY, "What to do when a client's send queue is full. \""+queuePolicyDropOldest+"\" drops the oldest message relayed from another client to make room. \""+queuePolicyDisconnect+"\" disconnects the client immediately. \""+queuePolicyBlock+"\" waits for room in the queue, up to the send queue timeout, then disconnects the client, holding up the client sending the message while it waits.")
+	flag.IntVar(&sendQueueTimeout, "send-queue-timeout", DEFAULT_SEND_QUEUE_TIMEOUT, "Number of seconds to wait for room in a full send queue with the block policy, before disconnecting the client. A value of 0 waits indefinitely.")
+
+	flag.IntVar(&banFailures, "ban-failures", DEFAULT_BAN_FAILURES, "Number of authorization failures from a single IP address within the ban window before the address is banned, such as invalid commands, or wrong passwords for locked channels. A value of 0 disables banning.")
+	flag.IntVar(&banWindow, "ban-window", DEFAULT_BAN_WINDOW, "Number of seconds in which authorization failures are counted towards a ban.")
+	flag.IntVar(&banTime, "ban-time", DEFAULT_BAN_TIME, "Number of seconds an IP address is banned for the first time. Each ban after that lasts twice as long as the one before it.")
+	flag.IntVar(&banMaxTime, "ban-max-time", DEFAULT_BAN_MAX_TIME, "The longest number of seconds an IP address can be banned for. Once a ban has been expired for this long, the next ban of the address will start over at the ban-time parameter.")
+	flag.StringVar(&banFile, "ban-file", DEFAULT_BAN_FILE, "File to save bans in, so they remain in effect when the server is restarted. If this is empty, bans are only kept in memory.")
+
+	flag.StringVar(&auditFile, "audit-file", DEFAULT_AUDIT_FILE, "File to add a JSON line to for every security relevant event, such as connections, channel joins, authorization failures, bans, and administrator actions. If this is empty, no audit trail is kept.")
+	flag.StringVar(&auditKeyFile, "audit-key-file", DEFAULT_AUDIT_KEY_FILE, "File containing a secret key. If this is set, every entry in the audit file includes an HMAC of itself and the entry before it, so changed or removed entries can be found with the audit-verify command.")
+
+	flag.StringVar(&recordDir, "record-dir", DEFAULT_RECORD_DIR, "Directory to save recordings of channels in, for debugging. If this is empty, no channels are recorded.")
+	flag.Var(&recordChannels, "record-channel", "Channel to record every message sent through, including keystrokes and speech, into the directory given by the record-dir parameter. Clients joining the channel will be warned through the message of the day. You can declare this parameter more than once for multiple channels.")
+
 	flag.StringVar(&motd, "motd", DEFAULT_MOTD, "Display a message of the day for the server.")
 	flag.BoolVar(&motdAlwaysDisplay, "motd-always-display", DEFAULT_MOTD_ALWAYS_DISPLAY, "Force the message of the day to be displayed upon each connection to the server, even if it hasn't changed.")
 
 	flag.BoolVar(&sendOrigin, "send-origin", DEFAULT_SEND_ORIGIN, "Send an origin message from every message received by a client.")
 
+	flag.StringVar(&adminSocket, "admin-socket", DEFAULT_ADMIN_SOCKET, "Path to a unix domain socket the server will listen on for administrative commands, such as listing or kicking clients. If this is empty, no admin socket will be created.")
+
+	flag.StringVar(&websocketAddress, "websocket-address", DEFAULT_WEBSOCKET_ADDRESS, "Address in the format ip:port to accept clients connecting through WebSockets over TLS, such as \":443\". Each text frame is one protocol message, and these clients can share channels with clients connecting directly. If this is empty, WebSocket connections won't be accepted.")
+	flag.StringVar(&websocketPath, "websocket-path", DEFAULT_WEBSOCKET_PATH, "Path clients connecting through WebSockets must request, such as \"/nvdaremote\".")
+
+	flag.StringVar(&metricsAddress, "metrics-address", DEFAULT_METRICS_ADDRESS, "Address in the format ip:port for an HTTP listener serving Prometheus metrics at the /metrics path, such as \"127.0.0.1:9837\". If this is empty, no metrics will be served.")
+
 	flag.BoolVar(&Launch, "launch", DEFAULT_LAUNCH, "Launch the server.")
 
 	flag.Parse()
+	flags_record()
 
 	if len(addresses) == 0 {
 		addresses = make(AddressList, 1)
@@ -91,6 +253,12 @@ func Configure() error {
 	cfg_err := c.Setup()
 
 	log_init(logfile)
+	logFormat = log_format_check(logFormat)
+	logMaxSize, logMaxAge, logMaxFiles = log_rotate_check(logMaxSize, logMaxAge, logMaxFiles)
+	log_rotate_set(log_rotate_get())
+	if Launch {
+		log_sink_set(log_sink_check(logSinkTarget, logSinkCAFile))
+	}
 
 	Log(LOG_INFO, "Initializing configuration.")
 	c.LogWrite()
@@ -106,120 +274,397 @@ func Configure() error {
 
 	defer PanicHandle.Catch()
 
-	generate := false
 	var config *tls.Config
 	var err error
 
-	if !default_cert_file(cert) && !fileExists(cert) {
-		Log(LOG_INFO, "The certificate file at "+cert+" does not exist.")
-		generate = true
+	if !default_acme_domains(acmeDomains) {
+		err = acme_setup()
+	} else {
+		err = cert_setup()
 	}
-	if !default_key_file(key) && !fileExists(key) {
-		Log(LOG_INFO, "The key file at "+key+" does not exist.")
-		generate = true
+	if err != nil {
+		Launch_fail()
+		return err
 	}
-	if default_cert_file(cert) || default_key_file(key) {
-		generate = true
+
+	config = &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if acmeManager != nil {
+		config.NextProtos = []string{acme.ALPNProto}
 	}
 
-	if generate {
-		Log(LOG_DEBUG, "Attempting to generate self-signed SSL certificate.")
-		config, err = gen_cert()
+	runCfg = &Cfg{}
+	runCfg.CmdGet()
+
+	proxy_check(proxyAddresses, proxyTrust)
+	upgradeTimeout = upgrade_timeout_check(upgradeTimeout)
+	loglevel = log_level_check(defaultHub, loglevel)
+	opts := runCfg.Options()
+	opts.LogLevel = loglevel
+	opts.Motd, opts.MotdAlwaysDisplay = motd_check(motd, motdAlwaysDisplay, loglevel)
+	defaultHub.SetOptions(opts)
+	send_origin_check(sendOrigin)
+
+	if !default_metrics_address(metricsAddress) {
+		err = address_valid(metricsAddress)
 		if err != nil {
-			Log_error("Unable to generate self-signed certificate.\r\n" + err.Error() + "\r\nUnable to start server.")
+			Log_error("The metrics address " + metricsAddress + " is invalid.\r\n" + err.Error() + "\r\nUnable to start server.")
 			Launch_fail()
 			return err
 		}
-		Log(LOG_DEBUG, "SSL certificate generated.")
-	} else {
-		if gencertfile != "" {
-			Log(LOG_INFO, "The server has not generated its own self-signed certificate, and the -gen-certfile parameter is set to "+gencertfile+". This parameter will be ignored.")
-		}
-		cert, cerr := tls.LoadX509KeyPair(cert, key)
-		if cerr != nil {
-			Log_error("Error loading certificate and key files.\r\n" + cerr.Error() + "\r\nUnable to start server.")
+	}
+
+	if !default_websocket_address(websocketAddress) {
+		err = address_valid(websocketAddress)
+		if err != nil {
+			Log_error("The WebSocket address " + websocketAddress + " is invalid.\r\n" + err.Error() + "\r\nUnable to start server.")
 			Launch_fail()
-			return cerr
+			return err
+		}
+	}
+	websocketPath = websocket_path_check(websocketPath)
+
+	err = bans.Load(banFile)
+	if err != nil {
+		Log_error("Unable to load bans from " + banFile + ". Starting with no bans, and the file will be overwritten when the bans change.\r\n" + err.Error())
+	} else if !default_ban_file(banFile) {
+		Log(LOG_DEBUG, "Loaded "+strconv.Itoa(len(bans.List()))+" active bans from "+banFile)
+	}
+
+	record_check(recordDir, recordChannels)
+
+	err = audits.Open(auditFile, auditKeyFile)
+	if err != nil {
+		Log_error("Unable to open the audit file " + auditFile + ". No audit trail will be kept.\r\n" + err.Error())
+	} else if !default_audit_file(auditFile) {
+		Log(LOG_DEBUG, "Adding security relevant events to the audit file "+auditFile)
+	}
+
+	if !Launch {
+		Log(LOG_INFO, "The server will not be launched. Shutting down.")
+		return errors.New("Server launch parameter set to false.")
+	}
+
+	tlsConfig = config
+	var servers []*Server
+	var ws *Server
+	if inherited := upgrade_listeners(); len(inherited) > 0 {
+		servers, ws = upgrade_servers(inherited, config)
+	} else if inherited := systemd_listeners(); len(inherited) > 0 {
+		servers, ws = systemd_servers(inherited, config)
+	} else {
+		servers = make([]*Server, len(addresses))
+		for i, addr := range addresses {
+			servers[i] = NewWithTLSConfig(addr, config)
+			servers[i].proxy = proxyAddresses.Contains(addr)
+			Log(LOG_DEBUG, "Starting server listening on address "+addr)
 		}
-		config = &tls.Config{
-			Certificates: []tls.Certificate{cert},
+		if !default_websocket_address(websocketAddress) {
+			ws = NewWebSocket(websocketAddress, websocketPath, config)
+			ws.proxy = proxyAddresses.Contains(websocketAddress)
+			Log(LOG_DEBUG, "Starting server listening for WebSocket connections on address "+websocketAddress+" at the path "+websocketPath)
 		}
 	}
+	if ws != nil {
+		servers = append(servers, ws)
+	}
+	defaultHub.svl.Lock()
+	defaultHub.servers = servers
+	defaultHub.svl.Unlock()
+
+	return nil
+}
 
-	config.MinVersion = tls.VersionTLS12
+// Start the hub given by Configure, returning the number of servers that are listening.
+func Start() int {
+	num := defaultHub.Start()
+	Servers = defaultHub.serverList()
+	if num == 0 {
+		return num
+	}
+
+	err := acme_http_listen(acmeHTTPAddress, acmeManager)
+	if err != nil {
+		Log_error("Unable to answer ACME HTTP-01 challenges on address " + acmeHTTPAddress + ".\r\n" + err.Error())
+	}
+	if acmeManager != nil {
+		go acme_prefetch(certs, acmeDomains)
+	}
+	err = metrics_listen(metricsAddress)
+	if err != nil {
+		Log_error("Unable to serve metrics on address " + metricsAddress + ".\r\n" + err.Error())
+	}
+	err = admin_listen(adminSocket)
+	if err != nil {
+		Log_error("Unable to listen on admin socket " + adminSocket + ".\r\n" + err.Error())
+	}
+	go signals_init()
+	go reload_init()
+	go upgrade_init()
+	go log_reopen_init()
+	go certs.watch(defaultHub.ctx)
+	log_sink_start()
+	return num
+}
 
-	if loglevel < LOG_SILENT {
-		loglevel = LOG_SILENT
-		Log(LOG_INFO, "Log level is less than silent log value, resetting to "+strconv.Itoa(LOG_SILENT))
+func log_level_check(h *Hub, level int) int {
+	if level < LOG_SILENT {
+		level = LOG_SILENT
+		h.Log(LOG_INFO, "Log level is less than silent log value, resetting to "+strconv.Itoa(LOG_SILENT))
 	}
-	if loglevel > LOG_PROTOCOL {
-		loglevel = LOG_PROTOCOL
-		Log(LOG_INFO, "Log level is greater than protocol log value, resetting to "+strconv.Itoa(LOG_PROTOCOL))
+	if level > LOG_PROTOCOL {
+		level = LOG_PROTOCOL
+		h.Log(LOG_INFO, "Log level is greater than protocol log value, resetting to "+strconv.Itoa(LOG_PROTOCOL))
 	}
+	return level
+}
+
+func log_format_check(format string) string {
+	switch format {
+	case LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+		return format
+	}
+	Log(LOG_INFO, "The log format \""+format+"\" is invalid. It must be "+LOG_FORMAT_TEXT+" or "+LOG_FORMAT_JSON+". Resetting to "+DEFAULT_LOG_FORMAT)
+	return DEFAULT_LOG_FORMAT
+}
 
-	if loglevel == LOG_PROTOCOL {
+func motd_check(m string, always bool, level int) (string, bool) {
+	if level == LOG_PROTOCOL {
 		Log(LOG_INFO, "Protocol logging is enabled. The server message of the day will be set to display always, and if unset, will have a value added to it that will alert all users connecting that protocol logging is enabled.")
 		protocollogmotd := "WARNING!\nAll server information is being logged, including the protocol being used. This server is running in an insecure mode for production."
-		if motd == "" {
-			motd = protocollogmotd
+		if m == "" {
+			m = protocollogmotd
 		} else {
-			motd = protocollogmotd + "\n" + motd
+			m = protocollogmotd + "\n" + m
 		}
-		motdAlwaysDisplay = true
+		always = true
 	}
 
-	if !default_motd(motd) {
-		logstr := "The server will display the following message of the day:\r\n" + motd
-		if default_motd_always_display(motdAlwaysDisplay) {
+	if !default_motd(m) {
+		logstr := "The server will display the following message of the day:\r\n" + m
+		if default_motd_always_display(always) {
 			logstr += "\r\nThe server will tell each client to display this message of the day upon each connection."
 		}
 		Log(LOG_DEBUG, logstr)
 	}
 
-	if default_motd(motd) && !default_motd_always_display(motdAlwaysDisplay) {
+	if default_motd(m) && !default_motd_always_display(always) {
 		Log(LOG_INFO, "The server has been told to always display a message of the day, but no message of the day has been set. The -motd-always-display parameter will be reset to false.")
-		motdAlwaysDisplay = false
+		always = false
 	}
+	return m, always
+}
 
-	if !sendOrigin {
-		Log(LOG_INFO, "The server is configured to send no origin message to other clients, which may improve performance slightly, but impact the useability of your server when the origin field is required.")
+func limits_check(h *Hub, maxConns, connsMinute, cmdsMinute int) (int, int, int) {
+	if maxConns < 0 {
+		h.Log(LOG_INFO, "The maximum number of connections per IP address is less than 0, resetting to 0.")
+		maxConns = 0
+	}
+	if connsMinute < 0 {
+		h.Log(LOG_INFO, "The maximum number of new connections per minute is less than 0, resetting to 0.")
+		connsMinute = 0
+	}
+	if cmdsMinute < 0 {
+		h.Log(LOG_INFO, "The maximum number of commands per minute is less than 0, resetting to 0.")
+		cmdsMinute = 0
+	}
+	if maxConns > 0 || connsMinute > 0 || cmdsMinute > 0 {
+		h.Log(LOG_DEBUG, "Rate limits for each IP address on each listening address: "+strconv.Itoa(maxConns)+" concurrent connections, "+strconv.Itoa(connsMinute)+" new connections per minute, "+strconv.Itoa(cmdsMinute)+" commands per minute before joining a channel. A value of 0 is unlimited.")
+	}
+	return maxConns, connsMinute, cmdsMinute
+}
+
+func deny_log_level_check(h *Hub, level int) int {
+	if level < LOG_INFO || level > LOG_PROTOCOL {
+		h.Log(LOG_INFO, "The log level for denied connections must be between "+strconv.Itoa(LOG_INFO)+" and "+strconv.Itoa(LOG_PROTOCOL)+", resetting to "+strconv.Itoa(DEFAULT_DENY_LOG_LEVEL))
+		level = DEFAULT_DENY_LOG_LEVEL
 	}
+	return level
+}
 
-	if !Launch {
-		Log(LOG_INFO, "The server will not be launched. Shutting down.")
-		return errors.New("Server launch parameter set to false.")
+func message_size_check(h *Hub, authSize, size int) (int, int) {
+	if authSize < 0 {
+		h.Log(LOG_INFO, "The maximum message size before joining a channel is less than 0, resetting to 0.")
+		authSize = 0
+	}
+	if size < 0 {
+		h.Log(LOG_INFO, "The maximum message size is less than 0, resetting to 0.")
+		size = 0
 	}
+	h.Log(LOG_DEBUG, "Maximum message size before joining a channel: "+strconv.Itoa(authSize)+" bytes. Maximum message size after joining a channel: "+strconv.Itoa(size)+" bytes. A value of 0 is unlimited.")
+	return authSize, size
+}
 
-	Servers = make([]*Server, len(addresses))
-	for i, addr := range addresses {
-		Servers[i] = NewWithTLSConfig(addr, config)
-		Log(LOG_DEBUG, "Starting server listening on address "+addr)
+func auth_timeout_check(h *Hub, timeout int) int {
+	if timeout < 0 {
+		h.Log(LOG_INFO, "The authentication timeout is less than 0, resetting to 0.")
+		timeout = 0
+	}
+	if timeout == 0 {
+		h.Log(LOG_DEBUG, "Clients will not be disconnected for failing to join a channel.")
+	} else {
+		h.Log(LOG_DEBUG, "Clients that haven't joined a channel within "+strconv.Itoa(timeout)+" seconds of connecting will be disconnected.")
 	}
+	return timeout
+}
 
-	return nil
+func upgrade_timeout_check(timeout int) int {
+	if timeout < 0 {
+		Log(LOG_INFO, "The upgrade timeout is less than 0, resetting to 0.")
+		timeout = 0
+	}
+	return timeout
 }
 
-func Start() int {
-	num := 0
-	var err error
+func drain_time_check(h *Hub, sec int) int {
+	if sec < 0 {
+		h.Log(LOG_INFO, "The drain time is less than 0, resetting to 0.")
+		sec = 0
+	}
+	return sec
+}
+
+func idle_timeout_check(h *Hub, master, slave int) (int, int) {
+	minimum := idle_check_sec * 2
+	if master < 0 {
+		h.Log(LOG_INFO, "The idle timeout for masters is less than 0, resetting to 0.")
+		master = 0
+	}
+	if master > 0 && master < minimum {
+		h.Log(LOG_INFO, "The idle timeout for masters is less than "+strconv.Itoa(minimum)+" seconds, resetting to "+strconv.Itoa(minimum))
+		master = minimum
+	}
+	if slave < 0 {
+		h.Log(LOG_INFO, "The idle timeout for slaves is less than 0, resetting to 0.")
+		slave = 0
+	}
+	if slave > 0 && slave < minimum {
+		h.Log(LOG_INFO, "The idle timeout for slaves is less than "+strconv.Itoa(minimum)+" seconds, resetting to "+strconv.Itoa(minimum))
+		slave = minimum
+	}
+	if master > 0 || slave > 0 {
+		h.Log(LOG_DEBUG, "Clients in a channel will be disconnected after not sending any data for "+strconv.Itoa(master)+" seconds for masters, and "+strconv.Itoa(slave)+" seconds for slaves. A value of 0 is unlimited.")
+	}
+	return master, slave
+}
+
+func send_queue_check(h *Hub, depth int, policy string, timeout int) (int, string, int) {
+	if depth < 1 {
+		h.Log(LOG_INFO, "The send queue depth is less than 1, resetting to "+strconv.Itoa(DEFAULT_SEND_QUEUE_DEPTH))
+		depth = DEFAULT_SEND_QUEUE_DEPTH
+	}
+	switch policy {
+	case queuePolicyBlock, queuePolicyDisconnect, queuePolicyDropOldest:
+	default:
+		h.Log(LOG_INFO, "The send queue policy \""+policy+"\" is invalid. It must be "+queuePolicyBlock+", "+queuePolicyDisconnect+", or "+queuePolicyDropOldest+". Resetting to "+DEFAULT_SEND_QUEUE_POLICY)
+		policy = DEFAULT_SEND_QUEUE_POLICY
+	}
+	if timeout < 0 {
+		h.Log(LOG_INFO, "The send queue timeout is less than 0, resetting to 0.")
+		timeout = 0
+	}
+	h.Log(LOG_DEBUG, "Each client can have "+strconv.Itoa(depth)+" messages waiting to be sent. When the queue is full, the "+policy+" policy will be used.")
+	return depth, policy, timeout
+}
+
+func ban_check(h *Hub, failures, window, banTime, maxTime int) (int, int, int, int) {
+	if failures < 0 {
+		h.Log(LOG_INFO, "The number of authorization failures before a ban is less than 0, resetting to 0.")
+		failures = 0
+	}
+	if window <= 0 {
+		h.Log(LOG_INFO, "The ban window must be greater than 0 seconds, resetting to "+strconv.Itoa(DEFAULT_BAN_WINDOW))
+		window = DEFAULT_BAN_WINDOW
+	}
+	if banTime <= 0 {
+		h.Log(LOG_INFO, "The ban time must be greater than 0 seconds, resetting to "+strconv.Itoa(DEFAULT_BAN_TIME))
+		banTime = DEFAULT_BAN_TIME
+	}
+	if maxTime < banTime {
+		h.Log(LOG_INFO, "The maximum ban time is less than the ban time, resetting to "+strconv.Itoa(banTime))
+		maxTime = banTime
+	}
+	if failures > 0 {
+		h.Log(LOG_DEBUG, "IP addresses will be banned after "+strconv.Itoa(failures)+" authorization failures within "+strconv.Itoa(window)+" seconds. Bans start at "+strconv.Itoa(banTime)+" seconds, up to a maximum of "+strconv.Itoa(maxTime)+" seconds.")
+	}
+	return failures, window, banTime, maxTime
+}
+
+func send_origin_check(origin bool) {
+	if !origin {
+		Log(LOG_INFO, "The server is configured to send no origin message to other clients, which may improve performance slightly, but impact the useability of your server when the origin field is required.")
+	}
+}
+
+func websocket_path_check(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		Log(LOG_INFO, "The WebSocket path \""+path+"\" is invalid. It must start with a slash. Resetting to "+DEFAULT_WEBSOCKET_PATH)
+		return DEFAULT_WEBSOCKET_PATH
+	}
+	return path
+}
+
+func cert_setup() error {
+	generate := false
+
+	if !default_cert_file(cert) && !fileExists(cert) {
+		Log(LOG_INFO, "The certificate file at "+cert+" does not exist.")
+		generate = true
+	}
+	if !default_key_file(key) && !fileExists(key) {
+		Log(LOG_INFO, "The key file at "+key+" does not exist.")
+		generate = true
+	}
+	if default_cert_file(cert) || default_key_file(key) {
+		generate = true
+	}
 
-	for i := range Servers {
-		err = Servers[i].Listen()
+	if generate {
+		Log(LOG_DEBUG, "Attempting to generate self-signed SSL certificate.")
+		config, err := gen_cert()
 		if err != nil {
-			Log_error("Unable to listen on address " + Servers[i].address + ".\r\n" + err.Error())
-			Servers[i] = nil
-			continue
+			Log_error("Unable to generate self-signed certificate.\r\n" + err.Error() + "\r\nUnable to start server.")
+			return err
 		}
-		num++
+		Log(LOG_DEBUG, "SSL certificate generated.")
+		certs = newCertStore(&config.Certificates[0])
+		return nil
 	}
-	if num == 0 {
-		Servers = nil
-		return num
+	if gencertfile != "" {
+		Log(LOG_INFO, "The server has not generated its own self-signed certificate, and the -gen-certfile parameter is set to "+gencertfile+". This parameter will be ignored.")
+	}
+	var err error
+	certs, err = newCertStoreFiles(cert, key)
+	if err != nil {
+		Log_error("Error loading certificate and key files.\r\n" + err.Error() + "\r\nUnable to start server.")
+		return err
 	}
+	Log(LOG_DEBUG, "Certificate loaded from "+cert+cert_expiry(certs))
+	return nil
+}
 
-	Log(LOG_DEBUG, "Number of servers started: "+strconv.Itoa(num))
-	go signals_init()
-	return num
+func acme_setup() error {
+	if !default_cert_file(cert) || !default_key_file(key) {
+		Log(LOG_INFO, "Certificates will be obtained from the ACME certificate authority at "+acmeDirectory+". The cert-file and key-file parameters will be ignored.")
+	}
+	var err error
+	acmeManager, err = acme_manager(acmeDomains, acmeEmail, acmeDirectory, acmeCacheDir, acmeCAFile)
+	if err != nil {
+		Log_error("Unable to configure the ACME client.\r\n" + err.Error() + "\r\nUnable to start server.")
+		return err
+	}
+	if !default_acme_http_address(acmeHTTPAddress) {
+		err = address_valid(acmeHTTPAddress)
+		if err != nil {
+			Log_error("The ACME HTTP address " + acmeHTTPAddress + " is invalid.\r\n" + err.Error() + "\r\nUnable to start server.")
+			return err
+		}
+	}
+	certs = newCertStoreACME(acmeManager, acmeDomains)
+	Log(LOG_DEBUG, "Certificates will be obtained automatically for "+strings.Join(acmeDomains, ", ")+", and stored in "+fullPath(acmeCacheDir))
+	return nil
 }
 
 func Launch_fail() {
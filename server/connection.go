@@ -18,6 +18,8 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TCP server.
@@ -29,17 +31,21 @@ type Server struct {
 	messageTerminator byte
 	ctx               context.Context
 	Stop              context.CancelFunc
-}
-
-var (
-	mctx            context.Context
-	StopServers     context.CancelFunc
-	msl             sync.Mutex
-	stoppingServers bool = false
-)
-
-func init() {
-	mctx, StopServers = context.WithCancel(context.Background())
+	limits            *rateLimiter
+	// If this is set, clients connect through WebSockets at this path, rather than directly over TLS.
+	wsPath string
+	// Connections start with a PROXY protocol header giving the address of the client.
+	proxy bool
+	// A listener passed by systemd, used instead of listening on the address.
+	inherited net.Listener
+	// Set while connections are being accepted, for the systemd watchdog.
+	accepting atomic.Bool
+	// The socket being listened on, which can be passed to a new process, and the listener connections are accepted from.
+	raw      net.Listener
+	listener net.Listener
+	// Set when the listener has been closed to stop accepting connections, while keeping the clients that are connected.
+	closing atomic.Bool
+	hub     *Hub
 }
 
 // Set message terminator.
@@ -56,80 +62,182 @@ func (s *Server) Listen() error {
 	var err error
 	config := s.config
 	address := s.address
+	wsPath := s.wsPath
+	proxy := s.proxy
+	listener = s.inherited
 	s.Unlock()
-	if config == nil {
+	if listener == nil {
 		listener, err = net.Listen("tcp", address)
-	} else {
-		listener, err = tls.Listen("tcp", address, config)
+		if err != nil {
+			return err
+		}
 	}
-	if err != nil {
-		return err
+	raw := listener
+	if proxy {
+		// The header comes before the TLS handshake.
+		listener = proxy_listen(s.hub, listener, address)
+	}
+	// For WebSockets, the TLS handshake is left to the HTTP server, so connections can be refused before it.
+	if wsPath == "" && config != nil {
+		listener = tls.NewListener(listener, config)
 	}
 	s.Lock()
-	s.ctx, s.Stop = context.WithCancel(mctx)
+	s.raw = raw
+	s.listener = listener
+	s.ctx, s.Stop = context.WithCancel(s.hub.ctx)
 	s.Add(1)
 	s.Unlock()
-	go s.accept(listener)
+	s.hub.sw.Add(1)
+	go func() {
+		s.Wait()
+		s.hub.sw.Done()
+	}()
+	go s.limits.watch(s.ctx)
+	s.accepting.Store(true)
+	if wsPath != "" {
+		go s.serveWebSocket(listener, config, wsPath)
+	} else {
+		go s.accept(listener)
+	}
 	return err
 }
 
+// The address the server is listening on, with the port chosen by the system if the address has port 0.
+func (s *Server) addr() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.raw == nil {
+		return s.address
+	}
+	return s.raw.Addr().String()
+}
+
 func (s *Server) accept(listener net.Listener) {
+	defer s.accepting.Store(false)
 	s.Lock()
 	address := s.address
 	s.Unlock()
 	// Stopping our server.
 	go func() {
 		<-s.ctx.Done()
-		msl.Lock()
-		if !stoppingServers {
-			Log(LOG_DEBUG, "The server at "+address+" has received a signal to stop.")
+		s.hub.msl.Lock()
+		if !s.hub.stopping {
+			s.hub.Log(LOG_DEBUG, "The server at "+address+" has received a signal to stop.")
 		}
-		msl.Unlock()
+		s.hub.msl.Unlock()
 		listener.Close()
 		s.Done()
 	}()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			msl.Lock()
-			if !stoppingServers {
-				Log(LOG_DEBUG, "Error accepting connections on the server at "+address+"\r\n"+err.Error()+"\r\nStopping server.")
+			if s.closing.Load() {
+				s.hub.Log(LOG_DEBUG, "The server at "+address+" has stopped accepting connections. Clients connected to it will remain connected.")
+				break
+			}
+			s.hub.msl.Lock()
+			if !s.hub.stopping {
+				s.hub.Log(LOG_DEBUG, "Error accepting connections on the server at "+address+"\r\n"+err.Error()+"\r\nStopping server.")
 			}
-			msl.Unlock()
+			s.hub.msl.Unlock()
 			s.Stop()
 			break
 		}
-		msl.Lock()
-		s.Lock()
-		client := &Client{
-			conn:              conn,
-			ip:                getIP(conn),
-			s:                 s,
-			messageTerminator: s.messageTerminator,
-			closed:            false,
+		ip, ok := s.allowed(conn)
+		if !ok {
+			continue
+		}
+		if !s.limits.connect(ip) {
+			conn.Close()
+			continue
 		}
-		client.ctx, client.Close = context.WithCancel(s.ctx)
-		s.Add(1)
-		AddClient(client)
-		s.Unlock()
-		msl.Unlock()
-		go client.listen()
+		go s.newClient(conn, ip).listen()
 	}
 }
 
-// Creates new tcp server instance.
+// Stop accepting connections, without disconnecting any client.
+func (s *Server) stopAccepting() {
+	s.Lock()
+	listener := s.listener
+	s.Unlock()
+	if listener == nil || s.closing.Swap(true) {
+		return
+	}
+	listener.Close()
+}
+
+// Check a new connection before the TLS handshake, closing it if it must be refused.
+func (s *Server) allowed(conn net.Conn) (string, bool) {
+	ip := getIP(conn)
+	if !s.access(ip) {
+		conn.Close()
+		return ip, false
+	}
+	if s.hub.bans.Banned(ip) {
+		s.hub.stats.banned.Add(1)
+		s.hub.Log(LOG_DEBUG, "Connection from "+ip+" to the server at "+s.address+" has been refused, because the address is banned.")
+		s.hub.audit(auditEntry{Event: "connection_banned", IP: ip})
+		conn.Close()
+		return ip, false
+	}
+	return ip, true
+}
+
+func (s *Server) newClient(conn net.Conn, ip string) *Client {
+	now := time.Now()
+	s.hub.msl.Lock()
+	s.Lock()
+	client := &Client{
+		conn:              conn,
+		ip:                ip,
+		s:                 s,
+		messageTerminator: s.messageTerminator,
+		closed:            false,
+		connected:         now,
+		lastRecv:          now,
+		sq:                newSendQueue(s.hub.sendQueue()),
+	}
+	client.ctx, client.Close = context.WithCancel(s.ctx)
+	s.hub.stats.connections.Add(1)
+	s.Add(1)
+	s.hub.AddClient(client)
+	s.Unlock()
+	s.hub.msl.Unlock()
+	return client
+}
+
+// Creates new tcp server instance, for the hub started by Start.
 func New(address string) *Server {
+	return defaultHub.newServer(address, nil)
+}
+
+func NewWithTLSConfig(address string, config *tls.Config) *Server {
+	return defaultHub.newServer(address, config)
+}
+
+// Creates a server accepting clients through WebSockets at the given path, for the hub started by Start.
+func NewWebSocket(address, path string, config *tls.Config) *Server {
+	return defaultHub.newWebSocket(address, path, config)
+}
+
+func (h *Hub) newServer(address string, config *tls.Config) *Server {
 	server := &Server{
 		address:           address,
+		config:            config,
 		messageTerminator: '\n',
+		limits:            newRateLimiter(h, address),
+		hub:               h,
 	}
 
 	return server
 }
 
-func NewWithTLSConfig(address string, config *tls.Config) *Server {
-	server := New(address)
-	server.config = config
+func (h *Hub) newWebSocket(address, path string, config *tls.Config) *Server {
+	// Browsers ask for HTTP/1.1 while connecting, and the TLS handshake fails if it isn't offered.
+	config = config.Clone()
+	config.NextProtos = append([]string{"http/1.1"}, config.NextProtos...)
+	server := h.newServer(address, config)
+	server.wsPath = path
 	return server
 }
 
@@ -31,6 +31,25 @@ var DEFAULT_LOG_FILE string = ""
 
 var DEFAULT_LOG_LEVEL int = 0
 
+var DEFAULT_LOG_FORMAT string = LOG_FORMAT_TEXT
+
+var (
+	DEFAULT_LOG_MAX_SIZE  int  = 0
+	DEFAULT_LOG_MAX_AGE   int  = 0
+	DEFAULT_LOG_MAX_FILES int  = 5
+	DEFAULT_LOG_COMPRESS  bool = false
+)
+
+var (
+	DEFAULT_LOG_SINK         string = ""
+	DEFAULT_LOG_SINK_CA_FILE string = ""
+)
+
+var (
+	DEFAULT_LOG_SECRETS bool   = false
+	DEFAULT_LOG_REDACT  string = REDACT_MASK
+)
+
 const (
 	LOG_SILENT     int = -1
 	LOG_INFO       int = 0
@@ -47,6 +66,68 @@ var (
 
 var DEFAULT_SEND_ORIGIN bool = true
 
+var DEFAULT_ADMIN_SOCKET string = ""
+
+var (
+	DEFAULT_WEBSOCKET_ADDRESS string = ""
+	DEFAULT_WEBSOCKET_PATH    string = "/"
+)
+
+var DEFAULT_METRICS_ADDRESS string = ""
+
+var (
+	DEFAULT_ACME_EMAIL        string = ""
+	DEFAULT_ACME_DIRECTORY    string = "https://acme-v02.api.letsencrypt.org/directory"
+	DEFAULT_ACME_CACHE_DIR    string = "acme"
+	DEFAULT_ACME_HTTP_ADDRESS string = ""
+	DEFAULT_ACME_CA_FILE      string = ""
+)
+
+var (
+	DEFAULT_MAX_CONNS_PER_IP int = 0
+	DEFAULT_CONNS_PER_MINUTE int = 0
+	DEFAULT_CMDS_PER_MINUTE  int = 0
+)
+
+var DEFAULT_DENY_LOG_LEVEL int = LOG_CONNECTION
+
+var (
+	DEFAULT_BAN_FAILURES int    = 0
+	DEFAULT_BAN_WINDOW   int    = 600
+	DEFAULT_BAN_TIME     int    = 600
+	DEFAULT_BAN_MAX_TIME int    = 86400
+	DEFAULT_BAN_FILE     string = ""
+)
+
+var (
+	DEFAULT_AUDIT_FILE     string = ""
+	DEFAULT_AUDIT_KEY_FILE string = ""
+)
+
+var DEFAULT_RECORD_DIR string = ""
+
+var (
+	DEFAULT_MAX_AUTH_MESSAGE_SIZE int = 16384
+	DEFAULT_MAX_MESSAGE_SIZE      int = 4194304
+)
+
+var DEFAULT_AUTH_TIMEOUT int = 60
+
+var DEFAULT_UPGRADE_TIMEOUT int = 3600
+
+var DEFAULT_DRAIN_TIME int = 0
+
+var (
+	DEFAULT_SEND_QUEUE_DEPTH   int    = 100
+	DEFAULT_SEND_QUEUE_POLICY  string = queuePolicyDropOldest
+	DEFAULT_SEND_QUEUE_TIMEOUT int    = write_sec
+)
+
+var (
+	DEFAULT_IDLE_TIMEOUT_MASTER int = 0
+	DEFAULT_IDLE_TIMEOUT_SLAVE  int = 0
+)
+
 var DEFAULT_CREATE_DIR bool = false
 
 var DEFAULT_LAUNCH bool = true
@@ -77,6 +158,42 @@ func default_log_level(p int) bool {
 	return (p == DEFAULT_LOG_LEVEL)
 }
 
+func default_log_format(p string) bool {
+	return (p == DEFAULT_LOG_FORMAT)
+}
+
+func default_log_max_size(p int) bool {
+	return (p == DEFAULT_LOG_MAX_SIZE)
+}
+
+func default_log_max_age(p int) bool {
+	return (p == DEFAULT_LOG_MAX_AGE)
+}
+
+func default_log_max_files(p int) bool {
+	return (p == DEFAULT_LOG_MAX_FILES)
+}
+
+func default_log_compress(p bool) bool {
+	return (p == DEFAULT_LOG_COMPRESS)
+}
+
+func default_log_sink(p string) bool {
+	return (p == DEFAULT_LOG_SINK)
+}
+
+func default_log_sink_ca_file(p string) bool {
+	return (p == DEFAULT_LOG_SINK_CA_FILE)
+}
+
+func default_log_secrets(p bool) bool {
+	return (p == DEFAULT_LOG_SECRETS)
+}
+
+func default_log_redact(p string) bool {
+	return (p == DEFAULT_LOG_REDACT)
+}
+
 func default_addresses(p AddressList) bool {
 	if len(p) == 1 && p[0] == DEFAULT_ADDRESS {
 		return true
@@ -111,6 +228,146 @@ func default_send_origin(p bool) bool {
 	return (p == DEFAULT_SEND_ORIGIN)
 }
 
+func default_admin_socket(p string) bool {
+	return (p == DEFAULT_ADMIN_SOCKET)
+}
+
+func default_websocket_address(p string) bool {
+	return (p == DEFAULT_WEBSOCKET_ADDRESS)
+}
+
+func default_websocket_path(p string) bool {
+	return (p == DEFAULT_WEBSOCKET_PATH)
+}
+
+func default_metrics_address(p string) bool {
+	return (p == DEFAULT_METRICS_ADDRESS)
+}
+
+func default_acme_domains(p DomainList) bool {
+	return (len(p) == 0)
+}
+
+func default_acme_email(p string) bool {
+	return (p == DEFAULT_ACME_EMAIL)
+}
+
+func default_acme_directory(p string) bool {
+	return (p == DEFAULT_ACME_DIRECTORY)
+}
+
+func default_acme_cache_dir(p string) bool {
+	return (p == DEFAULT_ACME_CACHE_DIR)
+}
+
+func default_acme_http_address(p string) bool {
+	return (p == DEFAULT_ACME_HTTP_ADDRESS)
+}
+
+func default_acme_ca_file(p string) bool {
+	return (p == DEFAULT_ACME_CA_FILE)
+}
+
+func default_max_conns_per_ip(p int) bool {
+	return (p == DEFAULT_MAX_CONNS_PER_IP)
+}
+
+func default_conns_per_minute(p int) bool {
+	return (p == DEFAULT_CONNS_PER_MINUTE)
+}
+
+func default_cmds_per_minute(p int) bool {
+	return (p == DEFAULT_CMDS_PER_MINUTE)
+}
+
+func default_cidr_list(p CIDRList) bool {
+	return (len(p) == 0)
+}
+
+func default_proxy_protocol(p AddressList) bool {
+	return (len(p) == 0)
+}
+
+func default_deny_log_level(p int) bool {
+	return (p == DEFAULT_DENY_LOG_LEVEL)
+}
+
+func default_max_auth_message_size(p int) bool {
+	return (p == DEFAULT_MAX_AUTH_MESSAGE_SIZE)
+}
+
+func default_max_message_size(p int) bool {
+	return (p == DEFAULT_MAX_MESSAGE_SIZE)
+}
+
+func default_auth_timeout(p int) bool {
+	return (p == DEFAULT_AUTH_TIMEOUT)
+}
+
+func default_upgrade_timeout(p int) bool {
+	return (p == DEFAULT_UPGRADE_TIMEOUT)
+}
+
+func default_drain_time(p int) bool {
+	return (p == DEFAULT_DRAIN_TIME)
+}
+
+func default_idle_timeout_master(p int) bool {
+	return (p == DEFAULT_IDLE_TIMEOUT_MASTER)
+}
+
+func default_idle_timeout_slave(p int) bool {
+	return (p == DEFAULT_IDLE_TIMEOUT_SLAVE)
+}
+
+func default_send_queue_depth(p int) bool {
+	return (p == DEFAULT_SEND_QUEUE_DEPTH)
+}
+
+func default_send_queue_policy(p string) bool {
+	return (p == DEFAULT_SEND_QUEUE_POLICY)
+}
+
+func default_send_queue_timeout(p int) bool {
+	return (p == DEFAULT_SEND_QUEUE_TIMEOUT)
+}
+
+func default_ban_failures(p int) bool {
+	return (p == DEFAULT_BAN_FAILURES)
+}
+
+func default_ban_window(p int) bool {
+	return (p == DEFAULT_BAN_WINDOW)
+}
+
+func default_ban_time(p int) bool {
+	return (p == DEFAULT_BAN_TIME)
+}
+
+func default_ban_max_time(p int) bool {
+	return (p == DEFAULT_BAN_MAX_TIME)
+}
+
+func default_ban_file(p string) bool {
+	return (p == DEFAULT_BAN_FILE)
+}
+
+func default_audit_file(p string) bool {
+	return (p == DEFAULT_AUDIT_FILE)
+}
+
+func default_audit_key_file(p string) bool {
+	return (p == DEFAULT_AUDIT_KEY_FILE)
+}
+
+func default_record_dir(p string) bool {
+	return (p == DEFAULT_RECORD_DIR)
+}
+
+func default_record_channels(p NameList) bool {
+	return (len(p) == 0)
+}
+
 func default_gen_conf_file(p string) bool {
 	return (p == DEFAULT_GEN_CONF_FILE)
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+)
+
+// Kept for code written before clients and channels belonged to a hub. Each of these uses the hub run by Configure and Start.
+var (
+	// The servers started by Start.
+	//
+	// Deprecated: Create servers with Hub.NewServer or Hub.NewWebSocketServer.
+	Servers []*Server
+	// Stops every server started by Start.
+	//
+	// Deprecated: Use Hub.Stop.
+	StopServers context.CancelFunc = stop_all
+)
+
+// Deprecated: Use Hub.AddClient.
+func AddClient(c *Client) {
+	defaultHub.AddClient(c)
+}
+
+// Deprecated: Use Hub.FindClient.
+func FindClient(c *Client) bool {
+	return defaultHub.FindClient(c)
+}
+
+// Deprecated: Use Hub.RemoveClient.
+func RemoveClient(c *Client) {
+	defaultHub.RemoveClient(c)
+}
+
+// Deprecated: Use Hub.AddChannel.
+func AddChannel(name, password string, locked bool, c *Client) {
+	defaultHub.AddChannel(name, password, locked, c)
+}
+
+// Deprecated: Use Hub.FindChannel.
+func FindChannel(name string) *ClientChannel {
+	return defaultHub.FindChannel(name)
+}
+
+// Deprecated: Use Hub.RemoveChannel.
+func RemoveChannel(name string) {
+	defaultHub.RemoveChannel(name)
+}
+
+// Deprecated: Use Hub.MessageReceived.
+func MessageReceived(c *Client, pmsg []byte) {
+	defaultHub.MessageReceived(c, pmsg)
+}
+
+// Deprecated: Use Hub.Authorize.
+func Authorize(c *Client, data []byte) error {
+	return defaultHub.Authorize(c, data)
+}
+
+// Deprecated: Use Hub.ListClients.
+func ListClients() []AdminClientData {
+	return defaultHub.ListClients()
+}
+
+// Deprecated: Use Hub.ListChannels.
+func ListChannels() []AdminChannelData {
+	return defaultHub.ListChannels()
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+type DomainList []string
+
+func (d *DomainList) String() string {
+	if len(*d) == 0 {
+		return ""
+	}
+	return strings.Join(*d, "\n")
+}
+
+func (d *DomainList) Set(v string) error {
+	err := domain_valid(v)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, strings.ToLower(v))
+	return nil
+}
+
+func domain_valid(v string) error {
+	if v == "" {
+		return errors.New("Empty domain is invalid.")
+	}
+	if strings.ContainsAny(v, " :/*") {
+		return errors.New("The domain " + v + " is invalid. Only a host name, such as example.com, is allowed.")
+	}
+	if !strings.Contains(strings.Trim(v, "."), ".") {
+		return errors.New("The domain " + v + " is invalid. A fully qualified host name, such as example.com, is required.")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"strconv"
+	"time"
+)
+
+func (h *Hub) drainTime() int {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return h.opts.DrainTime
+}
+
+// Refuse new connections and joins, stopping the hub once every channel is empty.
+func (h *Hub) drain(sec int) {
+	h.draining.Store(true)
+	for _, s := range h.serverList() {
+		s.stopAccepting()
+	}
+	h.Log(LOG_INFO, "The server has stopped accepting connections, and will shut down in "+drain_time_string(sec)+", or once every channel is empty. Send the signal again to shut down immediately.")
+	h.drainAnnounce(sec)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for remaining := sec; ; {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		remaining--
+		if h.channelCount() == 0 {
+			h.Log(LOG_INFO, "Every channel is empty. Shutting down.")
+			h.Stop()
+			return
+		}
+		if remaining <= 0 {
+			h.Log(LOG_INFO, "The drain time has ended. Disconnecting the "+strconv.Itoa(h.clientCount())+" clients remaining.")
+			h.Stop()
+			return
+		}
+		if remaining%60 == 0 || remaining == 30 || remaining == 10 {
+			h.drainAnnounce(remaining)
+		}
+	}
+}
+
+// Tell every connected client how long remains until the server shuts down.
+func (h *Hub) drainAnnounce(sec int) {
+	enc, err := Encode(Data{
+		Type:              "motd",
+		Motd:              "This server is shutting down in " + drain_time_string(sec) + ". Please reconnect later.",
+		MotdAlwaysDisplay: true,
+	})
+	if err != nil {
+		h.Log(LOG_DEBUG, "Unable to encode the shutdown message.\r\n"+err.Error())
+		return
+	}
+	num := 0
+	for _, c := range h.clientList() {
+		c.Send(enc)
+		num++
+	}
+	h.Log(LOG_DEBUG, "Told "+strconv.Itoa(num)+" clients the server is shutting down in "+drain_time_string(sec)+".")
+}
+
+func drain_time_string(sec int) string {
+	if sec%60 == 0 {
+		if sec == 60 {
+			return "1 minute"
+		}
+		return strconv.Itoa(sec/60) + " minutes"
+	}
+	if sec == 1 {
+		return "1 second"
+	}
+	return strconv.Itoa(sec) + " seconds"
+}
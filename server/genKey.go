@@ -5,14 +5,14 @@ import (
 	"strconv"
 )
 
-func gen_key() string {
+func gen_key(h *Hub) string {
 	min_num := 1000000
 	max_num := 10000000
 	var key string
 	var c *ClientChannel
 	for i := 0; i < 20; i++ {
 		key = strconv.Itoa(rand.Intn(max_num-min_num) + min_num)
-		c = FindChannel(key)
+		c = h.FindChannel(key)
 		if c == nil {
 			break
 		}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// A relay with its own clients, channels, servers and settings.
+type Hub struct {
+	// Clients and channels are added and removed under this lock.
+	sl       sync.Mutex
+	lastID   int
+	clients  map[*Client]struct{}
+	channels map[string]*ClientChannel
+
+	// Protects the settings, which can be changed while the hub is running.
+	rl   sync.RWMutex
+	opts Options
+	// Parsed from the lists of addresses in the settings.
+	exemptNets netList
+	allowNets  netList
+	denyNets   netList
+	proxyNets  netList
+
+	ctx  context.Context
+	stop context.CancelFunc
+	// Set under msl once the hub has been told to stop, so errors from connections being closed aren't logged.
+	msl      sync.Mutex
+	stopping bool
+	// Servers are added and removed under this lock.
+	svl     sync.Mutex
+	servers []*Server
+	sw      sync.WaitGroup
+	// Recordings that are still being written.
+	recs sync.WaitGroup
+	// Set once the hub has been told to shut down, and is waiting for its clients to leave.
+	draining atomic.Bool
+
+	stats  *metricCounters
+	bans   *banList
+	audits *auditLog
+	// If this is nil, messages are given to the logger set by SetLogger.
+	logger Logger
+}
+
+// Settings for a hub, named after their command line parameters. Times are in seconds.
+type Options struct {
+	LogLevel          int
+	LogSecrets        bool
+	LogRedact         string
+	Motd              string
+	MotdAlwaysDisplay bool
+	SendOrigin        bool
+	MaxConnsPerIP     int
+	ConnsPerMinute    int
+	CmdsPerMinute     int
+	RatelimitExempt   CIDRList
+	Allow             CIDRList
+	Deny              CIDRList
+	DenyLogLevel      int
+	ProxyTrust        CIDRList
+	BanFailures       int
+	BanWindow         int
+	BanTime           int
+	BanMaxTime        int
+	RecordDir         string
+	RecordChannels    NameList
+	MaxAuthMsgSize    int
+	MaxMsgSize        int
+	AuthTimeout       int
+	DrainTime         int
+	IdleTimeoutMaster int
+	IdleTimeoutSlave  int
+	SendQueueDepth    int
+	SendQueuePolicy   string
+	SendQueueTimeout  int
+}
+
+// The settings a hub has if none of the command line parameters are given.
+func DefaultOptions() Options {
+	return Options{
+		LogLevel:          DEFAULT_LOG_LEVEL,
+		LogSecrets:        DEFAULT_LOG_SECRETS,
+		LogRedact:         DEFAULT_LOG_REDACT,
+		Motd:              DEFAULT_MOTD,
+		MotdAlwaysDisplay: DEFAULT_MOTD_ALWAYS_DISPLAY,
+		SendOrigin:        DEFAULT_SEND_ORIGIN,
+		MaxConnsPerIP:     DEFAULT_MAX_CONNS_PER_IP,
+		ConnsPerMinute:    DEFAULT_CONNS_PER_MINUTE,
+		CmdsPerMinute:     DEFAULT_CMDS_PER_MINUTE,
+		DenyLogLevel:      DEFAULT_DENY_LOG_LEVEL,
+		BanFailures:       DEFAULT_BAN_FAILURES,
+		BanWindow:         DEFAULT_BAN_WINDOW,
+		BanTime:           DEFAULT_BAN_TIME,
+		BanMaxTime:        DEFAULT_BAN_MAX_TIME,
+		RecordDir:         DEFAULT_RECORD_DIR,
+		MaxAuthMsgSize:    DEFAULT_MAX_AUTH_MESSAGE_SIZE,
+		MaxMsgSize:        DEFAULT_MAX_MESSAGE_SIZE,
+		AuthTimeout:       DEFAULT_AUTH_TIMEOUT,
+		DrainTime:         DEFAULT_DRAIN_TIME,
+		IdleTimeoutMaster: DEFAULT_IDLE_TIMEOUT_MASTER,
+		IdleTimeoutSlave:  DEFAULT_IDLE_TIMEOUT_SLAVE,
+		SendQueueDepth:    DEFAULT_SEND_QUEUE_DEPTH,
+		SendQueuePolicy:   DEFAULT_SEND_QUEUE_POLICY,
+		SendQueueTimeout:  DEFAULT_SEND_QUEUE_TIMEOUT,
+	}
+}
+
+// The hub run by Configure and Start.
+var defaultHub = hub_default()
+
+func hub_default() *Hub {
+	h := hub_new(DefaultOptions())
+	h.stats = &stats
+	h.bans = bans
+	h.audits = audits
+	bans.hub = h
+	audits.hub = h
+	return h
+}
+
+// Create a hub without checking its settings, for the default hub, which is created before anything can be logged.
+func hub_new(opts Options) *Hub {
+	h := &Hub{
+		opts:  opts,
+		stats: &metricCounters{},
+		bans:  newBanList(),
+	}
+	h.audits = &auditLog{hub: h}
+	h.bans.hub = h
+	h.ctx, h.stop = context.WithCancel(context.Background())
+	return h
+}
+
+// Create a hub with the given settings, resetting any that are invalid.
+func NewHub(opts Options) *Hub {
+	h := hub_new(Options{})
+	h.SetOptions(opts)
+	return h
+}
+
+func (h *Hub) Options() Options {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return h.opts
+}
+
+// Change the settings of a running hub.
+func (h *Hub) SetOptions(opts Options) {
+	// The log level is changed first, so the rest of the settings are logged at the new level.
+	opts.LogLevel = log_level_check(h, opts.LogLevel)
+	h.rl.Lock()
+	h.opts.LogLevel = opts.LogLevel
+	h.rl.Unlock()
+	opts.LogRedact = log_redact_check(h, opts.LogSecrets, opts.LogRedact)
+	opts.MaxConnsPerIP, opts.ConnsPerMinute, opts.CmdsPerMinute = limits_check(h, opts.MaxConnsPerIP, opts.ConnsPerMinute, opts.CmdsPerMinute)
+	exempt := cidr_check(h, "ratelimit_exempt", opts.RatelimitExempt)
+	allow := cidr_check(h, "allow", opts.Allow)
+	deny := cidr_check(h, "deny", opts.Deny)
+	trusted := cidr_check(h, "proxy_trust", opts.ProxyTrust)
+	opts.DenyLogLevel = deny_log_level_check(h, opts.DenyLogLevel)
+	opts.BanFailures, opts.BanWindow, opts.BanTime, opts.BanMaxTime = ban_check(h, opts.BanFailures, opts.BanWindow, opts.BanTime, opts.BanMaxTime)
+	opts.MaxAuthMsgSize, opts.MaxMsgSize = message_size_check(h, opts.MaxAuthMsgSize, opts.MaxMsgSize)
+	opts.AuthTimeout = auth_timeout_check(h, opts.AuthTimeout)
+	opts.DrainTime = drain_time_check(h, opts.DrainTime)
+	opts.IdleTimeoutMaster, opts.IdleTimeoutSlave = idle_timeout_check(h, opts.IdleTimeoutMaster, opts.IdleTimeoutSlave)
+	opts.SendQueueDepth, opts.SendQueuePolicy, opts.SendQueueTimeout = send_queue_check(h, opts.SendQueueDepth, opts.SendQueuePolicy, opts.SendQueueTimeout)
+	h.rl.Lock()
+	defer h.rl.Unlock()
+	h.opts = opts
+	h.exemptNets = exempt
+	h.allowNets = allow
+	h.denyNets = deny
+	h.proxyNets = trusted
+}
+
+func (h *Hub) motd() (string, bool) {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return h.opts.Motd, h.opts.MotdAlwaysDisplay
+}
+
+func (h *Hub) sendOrigin() bool {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return h.opts.SendOrigin
+}
+
+// The maximum message size for a client, depending on whether it has joined a channel.
+func (h *Hub) messageSize(inChannel bool) int {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	if inChannel {
+		return h.opts.MaxMsgSize
+	}
+	return h.opts.MaxAuthMsgSize
+}
+
+// Give every message logged by this hub to l, rather than the logger set by SetLogger. A nil logger goes back to that one.
+func (h *Hub) SetLogger(l Logger) {
+	h.rl.Lock()
+	defer h.rl.Unlock()
+	h.logger = l
+}
+
+func (h *Hub) loggerGet() Logger {
+	h.rl.RLock()
+	l := h.logger
+	h.rl.RUnlock()
+	if l == nil {
+		return logger_get()
+	}
+	return l
+}
+
+// Log a message from this hub, if its log level allows it.
+func (h *Hub) Log(level int, msg ...interface{}) {
+	if !h.logEnabled(level) {
+		return
+	}
+	log_write(h.loggerGet(), h.redact(), level, msg)
+}
+
+func (h *Hub) Log_error(msg ...interface{}) {
+	log_error_write(h.loggerGet(), h.redact(), msg)
+}
+
+// Whether messages at the given level are being logged by this hub, to avoid preparing messages that won't be.
+func (h *Hub) logEnabled(level int) bool {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return level <= h.opts.LogLevel
+}
+
+// Add an entry to the audit trail of this hub. The channel name is hidden in the same way it is in the log.
+func (h *Hub) audit(e auditEntry) {
+	e.Channel = h.secret(e.Channel)
+	h.audits.Record(e)
+}
+
+// Create a server for this hub listening on address, which is started along with the hub.
+func (h *Hub) NewServer(address string, config *tls.Config) *Server {
+	s := h.newServer(address, config)
+	h.svl.Lock()
+	h.servers = append(h.servers, s)
+	h.svl.Unlock()
+	return s
+}
+
+// Create a server for this hub accepting clients through WebSockets at the given path, which is started along with the hub.
+func (h *Hub) NewWebSocketServer(address, path string, config *tls.Config) *Server {
+	s := h.newWebSocket(address, path, config)
+	h.svl.Lock()
+	h.servers = append(h.servers, s)
+	h.svl.Unlock()
+	return s
+}
+
+// Every server of this hub that is listening, or hasn't been started yet.
+func (h *Hub) serverList() []*Server {
+	h.svl.Lock()
+	defer h.svl.Unlock()
+	return append([]*Server(nil), h.servers...)
+}
+
+// Start every server of this hub, returning the number that are listening.
+func (h *Hub) Start() int {
+	h.svl.Lock()
+	running := make([]*Server, 0, len(h.servers))
+	for _, s := range h.servers {
+		err := s.Listen()
+		if err != nil {
+			if s.wsPath != "" {
+				h.Log_error("Unable to listen for WebSocket connections on address " + s.address + ".\r\n" + err.Error())
+			} else {
+				h.Log_error("Unable to listen on address " + s.address + ".\r\n" + err.Error())
+			}
+			continue
+		}
+		running = append(running, s)
+	}
+	h.servers = running
+	h.svl.Unlock()
+	num := len(running)
+	if num == 0 {
+		return num
+	}
+	h.Log(LOG_DEBUG, "Number of servers started: "+strconv.Itoa(num))
+	go h.bans.watch(h.ctx)
+	go h.idleWatch()
+	return num
+}
+
+// Stop every server of this hub, disconnecting every client.
+func (h *Hub) Stop() {
+	h.msl.Lock()
+	h.stopping = true
+	h.stop()
+	h.msl.Unlock()
+}
+
+// Wait until every server of this hub has stopped, and its recordings have been written.
+func (h *Hub) Wait() {
+	h.sw.Wait()
+	h.recs.Wait()
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps every message logged through it, so a test can check which hub logged what.
+type hubTestLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (l *hubTestLogger) Log(level int, msg string, attrs LogAttrs) {
+	l.Lock()
+	defer l.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func (l *hubTestLogger) Error(msg string, attrs LogAttrs) {
+	l.Log(LOG_INFO, msg, attrs)
+}
+
+func (l *hubTestLogger) count(s string) int {
+	l.Lock()
+	defer l.Unlock()
+	num := 0
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			num++
+		}
+	}
+	return num
+}
+
+func hub_test_start(t *testing.T, config *tls.Config, opts Options) (*Hub, string, *hubTestLogger) {
+	t.Helper()
+	l := &hubTestLogger{}
+	h := NewHub(opts)
+	h.SetLogger(l)
+	s := h.NewServer("127.0.0.1:0", config)
+	if h.Start() == 0 {
+		t.Fatal("Unable to start a hub.")
+	}
+	t.Cleanup(func() {
+		h.Stop()
+		h.Wait()
+	})
+	return h, s.addr(), l
+}
+
+// Join a channel, returning the connection and the ID the client was given, once the client has joined.
+func hub_test_join(t *testing.T, addr, channel, ctype string) (*tls.Conn, int) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	_, err = conn.Write([]byte(`{"type":"protocol_version","version":2}` + "\n" + `{"type":"join","channel":"` + channel + `","connection_type":"` + ctype + `"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Unable to join %s: %v", channel, err)
+		}
+		var d Data
+		if json.Unmarshal(line, &d) == nil && d.Type == "channel_joined" {
+			_ = conn.SetReadDeadline(time.Time{})
+			return conn, d.Origin
+		}
+	}
+}
+
+func hub_test_wait(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for " + what + ".")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Two hubs in one process keep their clients, channels, bans and logs to themselves.
+func TestHubIsolation(t *testing.T) {
+	config, err := gen_cert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts1 := DefaultOptions()
+	opts1.LogLevel = LOG_CHANNEL
+	opts1.BanFailures = 1
+	h1, addr1, l1 := hub_test_start(t, config, opts1)
+	opts2 := DefaultOptions()
+	opts2.LogLevel = LOG_SILENT
+	h2, addr2, l2 := hub_test_start(t, config, opts2)
+
+	channel := "lock_shared__password__secret"
+	hub_test_join(t, addr1, channel, connTypeSlave)
+	hub_test_join(t, addr1, channel, connTypeMaster)
+	_, id := hub_test_join(t, addr2, channel, connTypeSlave)
+	if id != 1 {
+		t.Fatalf("The first client of the second hub was given the ID %d.", id)
+	}
+
+	if n := h1.clientCount(); n != 2 {
+		t.Fatalf("Expected 2 clients on the first hub, got %d.", n)
+	}
+	if n := h2.clientCount(); n != 1 {
+		t.Fatalf("Expected 1 client on the second hub, got %d.", n)
+	}
+	cc1, cc2 := h1.FindChannel("shared"), h2.FindChannel("shared")
+	if cc1 == nil || cc2 == nil || cc1 == cc2 {
+		t.Fatal("Each hub should have its own channel.")
+	}
+	if n := len(cc1.Clients()); n != 2 {
+		t.Fatalf("Expected 2 clients in the first hub's channel, got %d.", n)
+	}
+	if n := len(cc2.Clients()); n != 1 {
+		t.Fatalf("Expected 1 client in the second hub's channel, got %d.", n)
+	}
+
+	// A wrong password bans the address on the first hub only.
+	hub_test_join(t, addr1, "lock_shared__password__wrong", connTypeMaster)
+	hub_test_wait(t, "the ban", func() bool {
+		return h1.bans.Banned("127.0.0.1")
+	})
+	if h2.bans.Banned("127.0.0.1") {
+		t.Fatal("A ban on the first hub was applied to the second.")
+	}
+	hub_test_join(t, addr2, channel, connTypeMaster)
+	if n := len(cc2.Clients()); n != 2 {
+		t.Fatalf("Expected 2 clients in the second hub's channel, got %d.", n)
+	}
+
+	// The first hub logs its own three joins, and the second hub logs nothing at its level.
+	hub_test_wait(t, "the joins to be logged", func() bool {
+		return l1.count("has joined channel") == 3
+	})
+	if n := l1.count("has connected from"); n != 3 {
+		t.Fatalf("Expected the first hub to log 3 connections, got %d.", n)
+	}
+	l2.Lock()
+	logged := len(l2.msgs)
+	l2.Unlock()
+	if logged != 0 {
+		t.Fatalf("The silent hub logged %d messages.", logged)
+	}
+	if h1.Options().LogLevel != LOG_CHANNEL || h2.Options().LogLevel != LOG_SILENT {
+		t.Fatal("The log level of one hub was changed by the other.")
+	}
+}
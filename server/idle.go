@@ -0,0 +1,83 @@
+package server
+
+import (
+	"strconv"
+	"time"
+)
+
+const idle_check_sec int = 5
+
+func (h *Hub) idleTimeout(connection string) time.Duration {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	switch connection {
+	case connTypeMaster:
+		return time.Duration(h.opts.IdleTimeoutMaster) * time.Second
+	case connTypeSlave:
+		return time.Duration(h.opts.IdleTimeoutSlave) * time.Second
+	}
+	return 0
+}
+
+func (c *Client) Received() {
+	defer c.Unlock()
+	c.Lock()
+	c.lastRecv = time.Now()
+	c.probed = false
+}
+
+func (c *Client) GetLastReceived() time.Time {
+	defer c.Unlock()
+	c.Lock()
+	return c.lastRecv
+}
+
+// Ping a client halfway through its idle timeout, and disconnect it at the end.
+func (c *Client) idleCheck(now time.Time) {
+	cc := c.GetChannel()
+	if cc == nil {
+		return
+	}
+	connection := c.GetConnectionType()
+	timeout := c.s.hub.idleTimeout(connection)
+	if timeout <= 0 {
+		return
+	}
+	c.Lock()
+	idle := now.Sub(c.lastRecv)
+	probe := !c.probed && idle >= timeout/2
+	if probe {
+		c.probed = true
+	}
+	id := c.id
+	ip := c.ip
+	c.Unlock()
+	if idle < timeout {
+		if probe {
+			c.Send(ping_msg)
+		}
+		return
+	}
+	c.s.hub.stats.idle(connection)
+	c.s.hub.Log(LOG_CONNECTION, "Client "+strconv.Itoa(id)+" has not sent any data for "+idle.Round(time.Second).String()+", which is longer than the idle timeout of "+timeout.String()+" for a "+connection+". Removing it from channel "+c.s.hub.secret(cc.Name())+" and closing connection.", log_fields("idle_timeout").Client(id).IP(ip).Channel(cc.Name()))
+	// Closing the connection removes the client from its channel, which tells the other clients it has left.
+	c.Close()
+}
+
+// Periodically check every client in a channel for being idle.
+func (h *Hub) idleWatch() {
+	t := time.NewTicker(time.Duration(idle_check_sec) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case now := <-t.C:
+			for _, cc := range h.channelList() {
+				for _, c := range cc.Clients() {
+					c.idleCheck(now)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_FORMAT_TEXT string = "text"
+	LOG_FORMAT_JSON string = "json"
+)
+
+const log_event_default string = "server"
+
+// Structured attributes of a log entry, written as fields in the JSON log format.
+type logFields struct {
+	event   string
+	client  int
+	ip      string
+	channel string
+}
+
+func log_fields(event string) logFields {
+	return logFields{event: event}
+}
+
+func (f logFields) Client(id int) logFields {
+	f.client = id
+	return f
+}
+
+func (f logFields) IP(ip string) logFields {
+	f.ip = ip
+	return f
+}
+
+// The channel name is a secret, so it is hidden unless secrets are being logged, once the message is given to a logger.
+func (f logFields) Channel(name string) logFields {
+	f.channel = name
+	return f
+}
+
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Event   string `json:"event"`
+	Client  int    `json:"client_id,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Message string `json:"message"`
+}
+
+func log_level_name(level int) string {
+	switch level {
+	case LOG_INFO:
+		return "info"
+	case LOG_CONNECTION:
+		return "connection"
+	case LOG_CHANNEL:
+		return "channel"
+	case LOG_DEBUG:
+		return "debug"
+	case LOG_PROTOCOL:
+		return "protocol"
+	}
+	return "error"
+}
+
+// Separate the structured fields from the message.
+func log_split(msg []interface{}) ([]interface{}, logFields) {
+	f := log_fields(log_event_default)
+	text := msg[:0:0]
+	for _, m := range msg {
+		if lf, ok := m.(logFields); ok {
+			f = lf
+			continue
+		}
+		text = append(text, m)
+	}
+	return text, f
+}
+
+func (f logFields) attrs(r redaction) LogAttrs {
+	return LogAttrs{
+		Event:   f.event,
+		Client:  f.client,
+		IP:      f.ip,
+		Channel: r.secret(f.channel),
+	}
+}
+
+func (a LogAttrs) fields() logFields {
+	if a.Event == "" {
+		a.Event = log_event_default
+	}
+	return logFields{
+		event:   a.Event,
+		client:  a.Client,
+		ip:      a.IP,
+		channel: a.Channel,
+	}
+}
+
+// The message parts joined into a single message, as they are printed in the text log format.
+func log_text(text []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(text...), "\n")
+}
+
+// The message with each line ending in a newline alone.
+func log_message(msg string) string {
+	return strings.ReplaceAll(msg, "\r\n", "\n")
+}
+
+// Encode a single log entry as one line of JSON.
+func log_json(level string, f logFields, msg string) []byte {
+	e := logEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   level,
+		Event:   f.event,
+		Client:  f.client,
+		IP:      f.ip,
+		Channel: f.channel,
+		Message: log_message(msg),
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		return []byte(`{"level":"error","event":"` + log_event_default + `","message":"Unable to encode log entry."}` + "\n")
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tech10/nvdaRemoteServer/signals"
+)
+
+// Suffix added to the name of a rotated log file, with ".gz" after it if it has been compressed.
+const log_rotate_format string = "2006-01-02T15-04-05.000"
+
+// The time at the start of each entry in the text log format, as written with log.LstdFlags.
+const log_text_time string = "2006/01/02 15:04:05"
+
+type logRotateSettings struct {
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	compress bool
+}
+
+func log_rotate_get() logRotateSettings {
+	rl.RLock()
+	defer rl.RUnlock()
+	return logRotateSettings{
+		maxSize:  int64(logMaxSize) * 1024 * 1024,
+		maxAge:   time.Duration(logMaxAge) * time.Second,
+		maxFiles: logMaxFiles,
+		compress: logCompress,
+	}
+}
+
+var (
+	// Compression and removal of rotated log files happen in the background, one rotation at a time.
+	lrl sync.Mutex
+	lrw sync.WaitGroup
+)
+
+// A log file that is rotated once it grows too large or too old. Every method must be called with ll held.
+type logFile struct {
+	logRotateSettings
+	name   string
+	f      *os.File
+	size   int64
+	opened time.Time
+	// After a failed rotation, the next attempt waits until this time, rather than being made on every write.
+	retry time.Time
+}
+
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = info.Size()
+	lf.opened = time.Now()
+	if lf.size > 0 {
+		// A file that already has entries, from before a restart or a reopen, is as old as its first entry.
+		lf.opened = log_file_started(lf.name, info)
+	}
+	return nil
+}
+
+// The time of the first entry in a log file, in either log format. If it can't be read, the time the file was last changed is used.
+func log_file_started(name string, info os.FileInfo) time.Time {
+	started := info.ModTime()
+	f, err := os.Open(name)
+	if err != nil {
+		return started
+	}
+	defer f.Close()
+	b := make([]byte, 4096)
+	n, _ := io.ReadFull(f, b)
+	line := string(b[:n])
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	var t time.Time
+	if strings.HasPrefix(line, "{") {
+		var e logEntry
+		if json.Unmarshal([]byte(line), &e) != nil {
+			return started
+		}
+		t, err = time.Parse(time.RFC3339Nano, e.Time)
+	} else {
+		line = strings.TrimPrefix(line, "[ERROR]: ")
+		if len(line) < len(log_text_time) {
+			return started
+		}
+		t, err = time.ParseInLocation(log_text_time, line[:len(log_text_time)], time.Local)
+	}
+	if err != nil || t.After(started) {
+		return started
+	}
+	return t
+}
+
+func (lf *logFile) close() error {
+	if lf.f == nil {
+		return nil
+	}
+	_ = lf.f.Sync()
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// Whether the file must be rotated before n more bytes are written to it. An empty file is never rotated.
+func (lf *logFile) due(n int) bool {
+	if lf.size == 0 || time.Now().Before(lf.retry) {
+		return false
+	}
+	if lf.maxSize > 0 && lf.size+int64(n) > lf.maxSize {
+		return true
+	}
+	return lf.maxAge > 0 && time.Since(lf.opened) >= lf.maxAge
+}
+
+func (lf *logFile) Write(b []byte) (int, error) {
+	if lf.f != nil && lf.due(len(b)) {
+		err := lf.rotate()
+		if err != nil {
+			lf.retry = time.Now().Add(time.Minute)
+			// The log lock is held, so the error can only be logged once this write has finished.
+			go Log_error("Unable to rotate log file " + lf.name + ".\r\n" + err.Error())
+		}
+	}
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := lf.f.Write(b)
+	lf.size += int64(n)
+	return n, err
+}
+
+// Rename the file with the current time added, and start a new one in its place.
+func (lf *logFile) rotate() error {
+	err := lf.close()
+	if err != nil {
+		return err
+	}
+	rotated := lf.name + "." + time.Now().Format(log_rotate_format)
+	rerr := os.Rename(lf.name, rotated)
+	err = lf.open()
+	if err != nil {
+		return err
+	}
+	if rerr != nil {
+		return rerr
+	}
+	lrw.Add(1)
+	go log_rotated(lf.name, lf.logRotateSettings)
+	return nil
+}
+
+// Compress rotated log files if requested, then remove the oldest ones beyond the number to keep.
+func log_rotated(name string, rs logRotateSettings) {
+	defer lrw.Done()
+	lrl.Lock()
+	defer lrl.Unlock()
+	rotated, err := log_rotated_list(name)
+	if err != nil {
+		Log_error("Unable to list rotated log files for " + name + ".\r\n" + err.Error())
+		return
+	}
+	if rs.compress {
+		for i, file := range rotated {
+			if strings.HasSuffix(file, ".gz") {
+				continue
+			}
+			err = log_compress(file)
+			if err != nil {
+				Log_error("Unable to compress rotated log file " + file + ".\r\n" + err.Error())
+				continue
+			}
+			rotated[i] = file + ".gz"
+		}
+	}
+	if rs.maxFiles <= 0 || len(rotated) <= rs.maxFiles {
+		return
+	}
+	for _, file := range rotated[:len(rotated)-rs.maxFiles] {
+		err = os.Remove(file)
+		if err != nil {
+			Log_error("Unable to remove rotated log file " + file + ".\r\n" + err.Error())
+		}
+	}
+}
+
+// Every rotated copy of the log file, oldest first.
+func log_rotated_list(name string) ([]string, error) {
+	dir, base := filepath.Split(name)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, e := range entries {
+		suffix, found := strings.CutPrefix(e.Name(), base+".")
+		if !found || e.IsDir() {
+			continue
+		}
+		_, err = time.Parse(log_rotate_format, strings.TrimSuffix(suffix, ".gz"))
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(dir, e.Name()))
+	}
+	// The time in each name sorts in the order the files were rotated.
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+func log_compress(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(file+".gz.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file+".gz.tmp", file+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(file + ".gz.tmp")
+		return err
+	}
+	_ = in.Close()
+	return os.Remove(file)
+}
+
+// Apply new rotation settings to the open log file.
+func log_rotate_set(rs logRotateSettings) {
+	ll.Lock()
+	defer ll.Unlock()
+	if log_file != nil {
+		log_file.logRotateSettings = rs
+	}
+}
+
+// Close and reopen the log file under the same name, after it has been moved away by another program such as logrotate.
+func log_reopen_current() error {
+	ll.Lock()
+	defer ll.Unlock()
+	if log_file == nil {
+		return nil
+	}
+	err := log_file.close()
+	if err != nil {
+		return err
+	}
+	return log_file.open()
+}
+
+func log_reopen_init() {
+	usr1 := signals.Reopen()
+	for {
+		select {
+		case <-defaultHub.ctx.Done():
+			return
+		case sig := <-usr1:
+			Log(LOG_INFO, "Signal received to reopen the log file. Received signal "+sig.String())
+			err := log_reopen_current()
+			if err != nil {
+				Log_error("Unable to reopen the log file.\r\n" + err.Error())
+			}
+		}
+	}
+}
+
+func log_rotate_check(maxSize, maxAge, maxFiles int) (int, int, int) {
+	if maxSize < 0 {
+		Log(LOG_INFO, "The maximum log file size can't be negative, resetting to "+strconv.Itoa(DEFAULT_LOG_MAX_SIZE))
+		maxSize = DEFAULT_LOG_MAX_SIZE
+	}
+	if maxAge < 0 {
+		Log(LOG_INFO, "The maximum log file age can't be negative, resetting to "+strconv.Itoa(DEFAULT_LOG_MAX_AGE))
+		maxAge = DEFAULT_LOG_MAX_AGE
+	}
+	if maxFiles < 0 {
+		Log(LOG_INFO, "The number of rotated log files to keep can't be negative, resetting to "+strconv.Itoa(DEFAULT_LOG_MAX_FILES))
+		maxFiles = DEFAULT_LOG_MAX_FILES
+	}
+	if maxSize > 0 || maxAge > 0 {
+		Log(LOG_DEBUG, "The log file will be rotated once it is larger than "+strconv.Itoa(maxSize)+" megabytes, or older than "+strconv.Itoa(maxAge)+" seconds, keeping "+strconv.Itoa(maxFiles)+" rotated files. A value of 0 is unlimited.")
+	}
+	return maxSize, maxAge, maxFiles
+}
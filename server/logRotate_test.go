@@ -0,0 +1,121 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A log file that already has entries keeps its age when it is opened again, such as after a restart.
+func TestLogFileAge(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	for _, tc := range []struct {
+		name    string
+		content string
+		due     bool
+	}{
+		{"text", old.Format(log_text_time) + " Server started.\n" + recent.Format(log_text_time) + " Client 1 connected.\n", true},
+		{"error", "[ERROR]: " + old.Format(log_text_time) + " Unable to listen.\n", true},
+		{"json", `{"time":"` + old.Format(time.RFC3339Nano) + `","level":"info","event":"server","message":"Server started."}` + "\n", true},
+		{"unreadable", "Not a log entry.\n", false},
+		{"recent", recent.Format(log_text_time) + " Server started.\n", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "server.log")
+			if err := os.WriteFile(name, []byte(tc.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			lf := &logFile{name: name, logRotateSettings: logRotateSettings{maxAge: time.Hour}}
+			if err := lf.open(); err != nil {
+				t.Fatal(err)
+			}
+			defer lf.close()
+			if due := lf.due(1); due != tc.due {
+				t.Fatalf("Expected the file to be due for rotation to be %v, opened at %v.", tc.due, lf.opened)
+			}
+		})
+	}
+}
+
+// A file is rotated before a write would take it past the maximum size, and only the newest rotated files are kept.
+func TestLogFileRotate(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "server.log")
+		lf := &logFile{name: name, logRotateSettings: logRotateSettings{maxSize: 100, maxFiles: 3, compress: compress}}
+		if err := lf.open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			line := "Entry " + strconv.Itoa(i) + strings.Repeat(".", 40) + "\n"
+			if _, err := lf.Write([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+			// Files rotated within the same millisecond would be given the same name.
+			time.Sleep(2 * time.Millisecond)
+		}
+		lf.close()
+		lrw.Wait()
+
+		rotated, err := log_rotated_list(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rotated) != lf.maxFiles {
+			t.Fatalf("Expected %d rotated files, got %v.", lf.maxFiles, rotated)
+		}
+		// Two entries fit in each file, so the newest rotated files hold entries 2 to 7, and the current one 8 and 9.
+		var entries []string
+		for _, file := range rotated {
+			if strings.HasSuffix(file, ".gz") != compress {
+				t.Fatalf("Expected compression of %s to be %v.", file, compress)
+			}
+			entries = append(entries, log_test_read(t, file)...)
+		}
+		current := log_test_read(t, name)
+		if len(current) != 2 {
+			t.Fatalf("Expected 2 entries in the current file, got %q.", current)
+		}
+		entries = append(entries, current...)
+		for i, e := range entries {
+			if !strings.HasPrefix(e, "Entry "+strconv.Itoa(i+2)+".") {
+				t.Fatalf("Expected entries 2 to 9 in order, got %q.", entries)
+			}
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > lf.maxSize {
+			t.Fatalf("The current file is %d bytes, past the maximum of %d.", info.Size(), lf.maxSize)
+		}
+	}
+}
+
+// The entries in a log file, which is decompressed if it ends in .gz.
+func log_test_read(t *testing.T, file string) []string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_SINK_JOURNALD   string = "journald"
+	log_journald_socket string = "/run/systemd/journal/socket"
+	log_sink_app        string = "nvdaRemoteServer"
+	// Private enterprise number reserved for documentation, used to name the structured data of each syslog message.
+	log_sink_sd_id string = "fields@32473"
+	// The daemon facility.
+	log_sink_facility int = 3
+	// Log entries waiting to be sent. Once this many are waiting, new entries are dropped.
+	log_sink_queue     int = 1000
+	log_sink_retry_sec int = 5
+)
+
+// Syslog severities.
+const (
+	log_severity_error  int = 3
+	log_severity_notice int = 5
+	log_severity_info   int = 6
+	log_severity_debug  int = 7
+)
+
+func log_severity(level int) int {
+	switch level {
+	case LOG_INFO:
+		return log_severity_notice
+	case LOG_CONNECTION, LOG_CHANNEL:
+		return log_severity_info
+	case LOG_DEBUG, LOG_PROTOCOL:
+		return log_severity_debug
+	}
+	return log_severity_error
+}
+
+// Sends log entries to journald or a syslog server in the background.
+type logSink struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	journald bool
+	hostname string
+	pid      string
+	entries  chan []byte
+	done     chan struct{}
+	// Set under ll once entries start being sent.
+	started bool
+	// The hub failures to send entries are logged through.
+	hub *Hub
+	// Only touched by the goroutine sending entries.
+	conn    net.Conn
+	failing bool
+	retry   time.Time
+	// Entries dropped since one was last sent.
+	dl      sync.Mutex
+	dropped int
+}
+
+// Parse a log sink, which is either journald, or a URL such as udp://host:514, tcp://host:601, or tls://host:6514.
+func log_sink_new(h *Hub, sink, caFile string) (*logSink, error) {
+	s := &logSink{
+		hub:     h,
+		pid:     strconv.Itoa(os.Getpid()),
+		entries: make(chan []byte, log_sink_queue),
+		done:    make(chan struct{}),
+	}
+	if sink == LOG_SINK_JOURNALD {
+		s.journald = true
+		s.network = "unixgram"
+		s.address = log_journald_socket
+		return s, nil
+	}
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, errors.New("The log sink " + sink + " must include a host and port, such as udp://localhost:514.")
+	}
+	s.address = u.Host
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.network = u.Scheme
+	case "tls":
+		s.network = "tcp"
+		s.tls = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+		if caFile != "" {
+			d, err := file_read(caFile)
+			if err != nil {
+				return nil, errors.New("Unable to read the log sink certificate authority file " + caFile + "\n" + err.Error())
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(d) {
+				return nil, errors.New("No certificates were found in the log sink certificate authority file " + caFile)
+			}
+			s.tls.RootCAs = pool
+		}
+	default:
+		return nil, errors.New("The log sink " + sink + " is invalid. It must be " + LOG_SINK_JOURNALD + ", or a URL starting with udp://, tcp://, or tls://.")
+	}
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+// Queue a log entry to be sent. The caller must hold ll.
+func (s *logSink) Send(severity int, f logFields, msg string) {
+	var b []byte
+	if s.journald {
+		b = s.journal(severity, f, msg)
+	} else {
+		b = s.syslog(severity, f, msg)
+	}
+	select {
+	case s.entries <- b:
+	default:
+		s.dl.Lock()
+		s.dropped++
+		s.dl.Unlock()
+	}
+}
+
+// Encode an entry for the native journald protocol, with the structured fields as journal fields.
+func (s *logSink) journal(severity int, f logFields, msg string) []byte {
+	var b bytes.Buffer
+	journal_field(&b, "MESSAGE", msg)
+	journal_field(&b, "PRIORITY", strconv.Itoa(severity))
+	journal_field(&b, "SYSLOG_IDENTIFIER", log_sink_app)
+	journal_field(&b, "EVENT", f.event)
+	if f.client != 0 {
+		journal_field(&b, "CLIENT_ID", strconv.Itoa(f.client))
+	}
+	if f.ip != "" {
+		journal_field(&b, "IP", f.ip)
+	}
+	if f.channel != "" {
+		journal_field(&b, "CHANNEL", f.channel)
+	}
+	return b.Bytes()
+}
+
+func journal_field(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	// Values containing a newline are given with their length instead.
+	b.WriteByte('\n')
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// Encode an entry as an RFC 5424 syslog message.
+func (s *logSink) syslog(severity int, f logFields, msg string) []byte {
+	var b bytes.Buffer
+	b.WriteString("<" + strconv.Itoa(log_sink_facility*8+severity) + ">1 ")
+	b.WriteString(time.Now().Format("2006-01-02T15:04:05.000000Z07:00") + " ")
+	b.WriteString(s.hostname + " " + log_sink_app + " " + s.pid + " " + f.event + " ")
+	var sd []string
+	if f.client != 0 {
+		sd = append(sd, "client_id=\""+strconv.Itoa(f.client)+"\"")
+	}
+	if f.ip != "" {
+		sd = append(sd, "ip=\""+syslog_escape(f.ip)+"\"")
+	}
+	if f.channel != "" {
+		sd = append(sd, "channel=\""+syslog_escape(f.channel)+"\"")
+	}
+	if len(sd) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + log_sink_sd_id + " " + strings.Join(sd, " ") + "]")
+	}
+	b.WriteString(" " + msg)
+	if s.network == "udp" {
+		return b.Bytes()
+	}
+	return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+}
+
+// Escape a structured data parameter value.
+func syslog_escape(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "]", "\\]").Replace(v)
+}
+
+func (s *logSink) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: time.Duration(write_sec) * time.Second}
+	if s.tls != nil {
+		return tls.DialWithDialer(d, s.network, s.address, s.tls)
+	}
+	return d.Dial(s.network, s.address)
+}
+
+// Send queued entries until the sink is closed, connecting again whenever the connection is lost.
+func (s *logSink) run() {
+	defer close(s.done)
+	for b := range s.entries {
+		if !s.write(b) {
+			s.dl.Lock()
+			s.dropped++
+			s.dl.Unlock()
+			continue
+		}
+		s.dl.Lock()
+		dropped := s.dropped
+		s.dropped = 0
+		s.dl.Unlock()
+		if dropped > 0 {
+			s.hub.Log_error(strconv.Itoa(dropped) + " log entries could not be sent to the log sink at " + s.address + ".")
+		}
+	}
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *logSink) write(b []byte) bool {
+	if time.Now().Before(s.retry) {
+		return false
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				s.fail(err)
+				return false
+			}
+			s.conn = conn
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(time.Duration(write_sec) * time.Second))
+		_, err := s.conn.Write(b)
+		if err == nil {
+			s.failing = false
+			return true
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+		// A connection that was closed by the other end is tried once more before giving up.
+		if attempt > 0 {
+			s.fail(err)
+		}
+	}
+	return false
+}
+
+// Drop entries for a while, rather than trying to connect for each of them.
+func (s *logSink) fail(err error) {
+	s.retry = time.Now().Add(time.Duration(log_sink_retry_sec) * time.Second)
+	if s.failing {
+		return
+	}
+	s.failing = true
+	s.hub.Log_error("Unable to send log entries to the log sink at " + s.address + ". Trying again in " + strconv.Itoa(log_sink_retry_sec) + " seconds.\r\n" + err.Error())
+}
+
+// Stop accepting entries, and wait a moment for any that are waiting to be sent.
+func (s *logSink) close() {
+	close(s.entries)
+	if !s.started {
+		return
+	}
+	select {
+	case <-s.done:
+	case <-time.After(time.Duration(write_sec) * time.Second):
+	}
+}
+
+// Start sending log entries to a sink, in addition to the console and log file.
+func log_sink_set(s *logSink) {
+	ll.Lock()
+	defer ll.Unlock()
+	log_sink = s
+	log_set(log_file)
+}
+
+// Start sending log entries that have been queued since the sink was set.
+func log_sink_start() {
+	ll.Lock()
+	defer ll.Unlock()
+	if log_sink != nil && !log_sink.started {
+		log_sink.started = true
+		go log_sink.run()
+	}
+}
+
+func log_sink_check(sink, caFile string) *logSink {
+	if sink == "" {
+		return nil
+	}
+	s, err := log_sink_new(defaultHub, sink, caFile)
+	if err != nil {
+		Log_error("Unable to use the log sink " + sink + ". Logging to the console only.\r\n" + err.Error())
+		return nil
+	}
+	Log(LOG_DEBUG, "Sending log entries to the log sink at "+sink)
+	return s
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sink_start(t *testing.T, sink string) *logSink {
+	t.Helper()
+	s, err := log_sink_new(defaultHub, sink, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.started = true
+	go s.run()
+	t.Cleanup(s.close)
+	return s
+}
+
+// Split an RFC 5424 message into its header, structured data and message, checking the header.
+func syslog_parse(t *testing.T, s *logSink, b []byte, severity int, event string) (string, string) {
+	t.Helper()
+	// PRI, VERSION, TIMESTAMP, HOSTNAME, APP-NAME, PROCID and MSGID are separated by single spaces.
+	parts := strings.SplitN(string(b), " ", 7)
+	if len(parts) != 7 {
+		t.Fatalf("Expected a full syslog header, got %q", b)
+	}
+	if pri := "<" + strconv.Itoa(log_sink_facility*8+severity) + ">1"; parts[0] != pri {
+		t.Fatalf("Expected the priority and version %q, got %q", pri, parts[0])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, parts[1]); err != nil {
+		t.Fatalf("The timestamp %q is invalid: %v", parts[1], err)
+	}
+	expected := []string{s.hostname, log_sink_app, s.pid, event}
+	for i, e := range expected {
+		if parts[i+2] != e {
+			t.Fatalf("Expected header field %d to be %q, got %q", i+2, e, parts[i+2])
+		}
+	}
+	rest := parts[6]
+	if strings.HasPrefix(rest, "- ") {
+		return "-", rest[2:]
+	}
+	end := strings.Index(rest, "] ")
+	if !strings.HasPrefix(rest, "[") || end < 0 {
+		t.Fatalf("Expected structured data, got %q", rest)
+	}
+	return rest[:end+1], rest[end+2:]
+}
+
+func TestLogSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s := sink_start(t, "udp://"+pc.LocalAddr().String())
+
+	ll.Lock()
+	s.Send(log_severity(LOG_CHANNEL), log_fields("client_joined").Client(3).IP("192.0.2.1").Channel(`a"b]c\d`), "Client 3 has joined.")
+	s.Send(log_severity(LOG_INFO), log_fields(log_event_default), "Server started.")
+	ll.Unlock()
+
+	b := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Datagrams aren't framed with their length.
+	sd, msg := syslog_parse(t, s, b[:n], log_severity_info, "client_joined")
+	if expected := `[` + log_sink_sd_id + ` client_id="3" ip="192.0.2.1" channel="a\"b\]c\\d"]`; sd != expected {
+		t.Fatalf("Expected the structured data %q, got %q", expected, sd)
+	}
+	if msg != "Client 3 has joined." {
+		t.Fatalf("Unexpected message %q", msg)
+	}
+
+	n, _, err = pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, msg = syslog_parse(t, s, b[:n], log_severity_notice, log_event_default)
+	if sd != "-" || msg != "Server started." {
+		t.Fatalf("Expected no structured data, got %q and the message %q", sd, msg)
+	}
+}
+
+func TestLogSinkTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := sink_start(t, "tcp://"+l.Addr().String())
+
+	messages := []string{"First entry.", "An entry\nspanning two lines.", "Last entry."}
+	ll.Lock()
+	for _, m := range messages {
+		s.Send(log_severity(LOG_DEBUG), log_fields("test").Client(1), m)
+	}
+	ll.Unlock()
+
+	_ = l.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, m := range messages {
+		// Each message is preceded by its length and a space, as described by RFC 6587.
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("Expected a message length, got %q", length)
+		}
+		b := make([]byte, size)
+		if _, err = io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		_, msg := syslog_parse(t, s, b, log_severity_debug, "test")
+		if msg != m {
+			t.Fatalf("Expected the message %q, got %q", m, msg)
+		}
+	}
+}
+
+// Decode a datagram in the native journald protocol.
+func journal_parse(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for len(b) > 0 {
+		i := bytes.IndexAny(b, "=\n")
+		if i < 0 {
+			t.Fatalf("Incomplete journal field %q", b)
+		}
+		name := string(b[:i])
+		if b[i] == '=' {
+			end := bytes.IndexByte(b[i+1:], '\n')
+			if end < 0 {
+				t.Fatalf("The journal field %s has no newline.", name)
+			}
+			fields[name] = string(b[i+1 : i+1+end])
+			b = b[i+1+end+1:]
+			continue
+		}
+		// A field followed by a newline has its length as a 64 bit little endian integer, then the value and a newline.
+		b = b[i+1:]
+		if len(b) < 8 {
+			t.Fatalf("The journal field %s has no length.", name)
+		}
+		size := int(binary.LittleEndian.Uint64(b[:8]))
+		b = b[8:]
+		if len(b) < size+1 || b[size] != '\n' {
+			t.Fatalf("The journal field %s doesn't have %d bytes followed by a newline.", name, size)
+		}
+		fields[name] = string(b[:size])
+		b = b[size+1:]
+	}
+	return fields
+}
+
+func TestLogSinkJournald(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("Unix datagram sockets aren't available on " + runtime.GOOS + ".")
+	}
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := log_sink_new(defaultHub, LOG_SINK_JOURNALD, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.address = path
+	s.started = true
+	go s.run()
+	t.Cleanup(s.close)
+
+	msg := "Data received from client 2\n{\"type\":\"key\"}"
+	ll.Lock()
+	s.Send(log_severity(LOG_PROTOCOL), log_fields("data_received").Client(2).IP("192.0.2.2").Channel("channel=x"), msg)
+	ll.Unlock()
+
+	b := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := journal_parse(t, b[:n])
+	expected := map[string]string{
+		"MESSAGE":           msg,
+		"PRIORITY":          strconv.Itoa(log_severity_debug),
+		"SYSLOG_IDENTIFIER": log_sink_app,
+		"EVENT":             "data_received",
+		"CLIENT_ID":         "2",
+		"IP":                "192.0.2.2",
+		"CHANNEL":           "channel=x",
+	}
+	for k, v := range expected {
+		if fields[k] != v {
+			t.Fatalf("Expected the journal field %s to be %q, got %q", k, v, fields[k])
+		}
+	}
+	if len(fields) != len(expected) {
+		t.Fatalf("Expected %d journal fields, got %d: %v", len(expected), len(fields), fields)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build go1.21
+// +build go1.21
+
+package server
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Gives messages to a log/slog logger.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func slog_level(level int) slog.Level {
+	switch level {
+	case LOG_DEBUG:
+		return slog.LevelDebug
+	case LOG_PROTOCOL:
+		return slog.LevelDebug - 4
+	}
+	return slog.LevelInfo
+}
+
+func slog_attrs(level string, a LogAttrs) []slog.Attr {
+	attrs := make([]slog.Attr, 0, 5)
+	attrs = append(attrs, slog.String("log_level", level))
+	event := a.Event
+	if event == "" {
+		event = log_event_default
+	}
+	attrs = append(attrs, slog.String("event", event))
+	if a.Client != 0 {
+		attrs = append(attrs, slog.Int("client_id", a.Client))
+	}
+	if a.IP != "" {
+		attrs = append(attrs, slog.String("ip", a.IP))
+	}
+	if a.Channel != "" {
+		attrs = append(attrs, slog.String("channel", a.Channel))
+	}
+	return attrs
+}
+
+func (s slogLogger) Log(level int, msg string, attrs LogAttrs) {
+	s.l.LogAttrs(context.Background(), slog_level(level), log_message(msg), slog_attrs(log_level_name(level), attrs)...)
+}
+
+func (s slogLogger) Error(msg string, attrs LogAttrs) {
+	s.l.LogAttrs(context.Background(), slog.LevelError, log_message(msg), slog_attrs("error", attrs)...)
+}
@@ -7,33 +7,129 @@ import (
 	"sync"
 )
 
+// Receives every message the server logs, from any number of goroutines.
+type Logger interface {
+	Log(level int, msg string, attrs LogAttrs)
+	Error(msg string, attrs LogAttrs)
+}
+
+// Structured attributes of a log entry. Client is 0, and the other fields are empty, if they don't apply to the entry.
+type LogAttrs struct {
+	Event   string
+	Client  int
+	IP      string
+	Channel string
+}
+
 var ll sync.Mutex
 
+// Protects the logger every message is given to, unless a hub has its own.
+var lgl sync.RWMutex
+
+var log_logger Logger = stdLogger{}
+
 var (
 	log_standard *log.Logger
 	log_error    *log.Logger
-	log_file     *os.File
+	log_file     *logFile
+	// Destinations without a prefix or timestamp, for the JSON log format.
+	log_out     io.Writer
+	log_err_out io.Writer
+	// Where log entries are sent in addition to the console and log file, if anywhere.
+	log_sink *logSink
 )
 
-func Log(level int, msg ...interface{}) {
-	if level > loglevel {
-		return
+func init() {
+	// Messages logged before Configure are written to the console.
+	log_set(nil)
+}
+
+// Replace the logger used by hubs without their own. A nil logger restores the standard logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
 	}
+	lgl.Lock()
+	defer lgl.Unlock()
+	log_logger = l
+}
+
+func logger_get() Logger {
+	lgl.RLock()
+	defer lgl.RUnlock()
+	return log_logger
+}
+
+// The logger used by the command line server, writing to the console, the log file and the log sink in the chosen log format.
+func StandardLogger() Logger {
+	return stdLogger{}
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Log(level int, msg string, attrs LogAttrs) {
+	_, format := log_get()
+	f := attrs.fields()
 	ll.Lock()
 	defer ll.Unlock()
-	log_standard.Println(msg...)
+	if log_sink != nil {
+		log_sink.Send(log_severity(level), f, log_message(msg))
+	}
+	if format == LOG_FORMAT_JSON {
+		_, _ = log_out.Write(log_json(log_level_name(level), f, msg))
+		return
+	}
+	log_standard.Println(msg)
 }
 
-func Log_error(msg ...interface{}) {
+func (stdLogger) Error(msg string, attrs LogAttrs) {
+	_, format := log_get()
+	f := attrs.fields()
 	ll.Lock()
 	defer ll.Unlock()
-	log_error.Println(msg...)
+	if log_sink != nil {
+		log_sink.Send(log_severity_error, f, log_message(msg))
+	}
+	if format == LOG_FORMAT_JSON {
+		_, _ = log_err_out.Write(log_json("error", f, msg))
+		return
+	}
+	log_error.Println(msg)
+}
+
+// Log a message at the given level. A logFields value can be given among the message parts to attach structured attributes.
+func Log(level int, msg ...interface{}) {
+	lvl, _ := log_get()
+	if level > lvl {
+		return
+	}
+	log_write(logger_get(), defaultHub.redact(), level, msg)
+}
+
+// Give a message that has already been checked against the log level to a logger, hiding the channel in its fields.
+func log_write(l Logger, r redaction, level int, msg []interface{}) {
+	text, f := log_split(msg)
+	l.Log(level, log_text(text), f.attrs(r))
+}
+
+// Whether messages at the given level are being logged, to avoid preparing messages that won't be.
+func log_enabled(level int) bool {
+	lvl, _ := log_get()
+	return level <= lvl
+}
+
+func Log_error(msg ...interface{}) {
+	log_error_write(logger_get(), defaultHub.redact(), msg)
+}
+
+func log_error_write(l Logger, r redaction, msg []interface{}) {
+	text, f := log_split(msg)
+	l.Error(log_text(text), f.attrs(r))
 }
 
 func log_init(file string) {
 	if file == "" {
-		log_standard = log.New(os.Stdout, "", log.LstdFlags)
-		log_error = log.New(os.Stderr, "[ERROR]: ", log.LstdFlags)
+		log_set(nil)
 		return
 	}
 	file = fullPath(file)
@@ -42,24 +138,81 @@ func log_init(file string) {
 		Log(LOG_INFO, "The log file at "+file+" will not be written, as the server has been told not to launch.")
 		return
 	}
-	w, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	w, err := log_open(file)
 	if err != nil {
 		log_init("")
 		Log_error("Unable to open log file " + file + " for writing.\r\n" + err.Error())
 		return
 	}
-	log_standard = log.New(io.MultiWriter(os.Stdout, w), "", log.LstdFlags)
-	log_error = log.New(io.MultiWriter(os.Stderr, w), "[ERROR]: ", log.LstdFlags)
+	log_set(w)
+}
+
+func log_open(file string) (*logFile, error) {
+	lf := &logFile{
+		logRotateSettings: log_rotate_get(),
+		name:              fullPath(file),
+	}
+	err := lf.open()
+	if err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// Point the loggers at standard output and error, and optionally a file. The caller must hold ll if logging has started.
+func log_set(w *logFile) {
 	log_file = w
+	var stdout io.Writer = os.Stdout
+	if log_sink != nil && log_sink.journald {
+		// Under systemd, standard output already goes to the journal.
+		stdout = io.Discard
+	}
+	if w == nil {
+		log_out = stdout
+		log_err_out = os.Stderr
+	} else {
+		log_out = io.MultiWriter(stdout, w)
+		log_err_out = io.MultiWriter(os.Stderr, w)
+	}
+	log_standard = log.New(log_out, "", log.LstdFlags)
+	log_error = log.New(log_err_out, "[ERROR]: ", log.LstdFlags)
+}
+
+// Switch logging to a different file while the server is running. An empty file logs to the console only.
+func log_reopen(file string) error {
+	var w *logFile
+	var err error
+	if file != "" {
+		w, err = log_open(file)
+		if err != nil {
+			return err
+		}
+	}
+	ll.Lock()
+	defer ll.Unlock()
+	old := log_file
+	log_set(w)
+	if old != nil {
+		_ = old.close()
+	}
+	return nil
 }
 
 func Log_close() {
+	// Let rotated files finish being compressed, which may log errors.
+	lrw.Wait()
+	ll.Lock()
+	s := log_sink
+	log_sink = nil
+	ll.Unlock()
+	if s != nil {
+		s.close()
+	}
 	ll.Lock()
 	defer ll.Unlock()
 	if log_file == nil {
 		return
 	}
-	_ = log_file.Sync()
-	_ = log_file.Close()
+	_ = log_file.close()
 	log_file = nil
 }
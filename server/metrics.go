@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dirMasterToSlave string = "master_to_slave"
+	dirSlaveToMaster string = "slave_to_master"
+	dirOther         string = "other"
+)
+
+// Counters updated from the connection hot paths. These are only ever
+// touched atomically, so no lock is taken when a message is relayed.
+type metricCounters struct {
+	connections      atomic.Uint64
+	msgMasterToSlave atomic.Uint64
+	msgSlaveToMaster atomic.Uint64
+	msgOther         atomic.Uint64
+	bytMasterToSlave atomic.Uint64
+	bytSlaveToMaster atomic.Uint64
+	bytOther         atomic.Uint64
+	notConnected     atomic.Uint64
+	authFailures     atomic.Uint64
+	droppedSends     atomic.Uint64
+	handshakeErrors  atomic.Uint64
+	denied           atomic.Uint64
+	banned           atomic.Uint64
+	tooLarge         atomic.Uint64
+	queueDropped     atomic.Uint64
+	queueDisconnects atomic.Uint64
+	bans             atomic.Uint64
+
+	limitConnections    atomic.Uint64
+	limitConnectionRate atomic.Uint64
+	limitCommandRate    atomic.Uint64
+
+	authTimeoutHandshake atomic.Uint64
+	authTimeoutCommand   atomic.Uint64
+	authTimeoutJoin      atomic.Uint64
+
+	idleMaster atomic.Uint64
+	idleSlave  atomic.Uint64
+
+	joinTime metricHistogram
+}
+
+// Upper bounds in seconds of the buckets for the time taken to join a channel.
+var joinTimeBuckets = [...]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// A histogram updated atomically. The sum is kept in microseconds so it can be stored in an integer.
+type metricHistogram struct {
+	counts [len(joinTimeBuckets) + 1]atomic.Uint64
+	sum    atomic.Uint64
+	count  atomic.Uint64
+}
+
+var stats metricCounters
+
+var (
+	ml             sync.Mutex
+	metrics_server *http.Server
+)
+
+func (m *metricCounters) relayed(direction string, size int) {
+	switch direction {
+	case dirMasterToSlave:
+		m.msgMasterToSlave.Add(1)
+		m.bytMasterToSlave.Add(uint64(size))
+	case dirSlaveToMaster:
+		m.msgSlaveToMaster.Add(1)
+		m.bytSlaveToMaster.Add(uint64(size))
+	default:
+		m.msgOther.Add(1)
+		m.bytOther.Add(uint64(size))
+	}
+}
+
+func (m *metricCounters) authTimeout(stage string) {
+	switch stage {
+	case authStageHandshake:
+		m.authTimeoutHandshake.Add(1)
+	case authStageCommand:
+		m.authTimeoutCommand.Add(1)
+	default:
+		m.authTimeoutJoin.Add(1)
+	}
+}
+
+func (m *metricCounters) idle(connection string) {
+	if connection == connTypeMaster {
+		m.idleMaster.Add(1)
+		return
+	}
+	m.idleSlave.Add(1)
+}
+
+func (h *metricHistogram) observe(v float64) {
+	i := 0
+	for i < len(joinTimeBuckets) && v > joinTimeBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(uint64(v * 1e6))
+	h.count.Add(1)
+}
+
+func relayDirection(connection string) string {
+	switch connection {
+	case connTypeMaster:
+		return dirMasterToSlave
+	case connTypeSlave:
+		return dirSlaveToMaster
+	default:
+		return dirOther
+	}
+}
+
+type metricWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricWriter) head(name, mtype, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + mtype + "\n")
+}
+
+func (w *metricWriter) value(name, labels string, v uint64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + strconv.FormatUint(v, 10) + "\n")
+}
+
+func (w *metricWriter) histogram(name, help string, buckets []float64, h *metricHistogram) {
+	w.head(name, "histogram", help)
+	var total uint64
+	for i, b := range buckets {
+		total += h.counts[i].Load()
+		w.value(name+"_bucket", `le="`+strconv.FormatFloat(b, 'f', -1, 64)+`"`, total)
+	}
+	total += h.counts[len(buckets)].Load()
+	w.value(name+"_bucket", `le="+Inf"`, total)
+	w.WriteString(name + "_sum " + strconv.FormatFloat(float64(h.sum.Load())/1e6, 'f', -1, 64) + "\n")
+	w.value(name+"_count", "", h.count.Load())
+}
+
+func (w *metricWriter) single(name, mtype, help string, v uint64) {
+	w.head(name, mtype, help)
+	w.value(name, "", v)
+}
+
+// Render every metric in the Prometheus text exposition format.
+// Gauges are computed from the client and channel maps at scrape time.
+func metrics_render() []byte {
+	var masters, slaves, other uint64
+	for _, cd := range defaultHub.ListClients() {
+		switch cd.ConnectionType {
+		case connTypeMaster:
+			masters++
+		case connTypeSlave:
+			slaves++
+		default:
+			other++
+		}
+	}
+	var locked, unlocked uint64
+	for _, cd := range defaultHub.ListChannels() {
+		if cd.Locked {
+			locked++
+		} else {
+			unlocked++
+		}
+	}
+
+	w := &metricWriter{}
+	w.head("nvda_remote_clients", "gauge", "Connected clients by connection type.")
+	w.value("nvda_remote_clients", `connection_type="master"`, masters)
+	w.value("nvda_remote_clients", `connection_type="slave"`, slaves)
+	w.value("nvda_remote_clients", `connection_type="none"`, other)
+	w.single("nvda_remote_channels_active", "gauge", "Active channels.", locked+unlocked)
+	w.head("nvda_remote_channels", "gauge", "Active channels by lock state.")
+	w.value("nvda_remote_channels", `locked="true"`, locked)
+	w.value("nvda_remote_channels", `locked="false"`, unlocked)
+	w.single("nvda_remote_connections_total", "counter", "Connections accepted.", stats.connections.Load())
+	w.head("nvda_remote_messages_relayed_total", "counter", "Messages relayed between clients in a channel, counted per recipient.")
+	w.value("nvda_remote_messages_relayed_total", `direction="`+dirMasterToSlave+`"`, stats.msgMasterToSlave.Load())
+	w.value("nvda_remote_messages_relayed_total", `direction="`+dirSlaveToMaster+`"`, stats.msgSlaveToMaster.Load())
+	w.value("nvda_remote_messages_relayed_total", `direction="`+dirOther+`"`, stats.msgOther.Load())
+	w.head("nvda_remote_bytes_relayed_total", "counter", "Bytes relayed between clients in a channel, counted per recipient.")
+	w.value("nvda_remote_bytes_relayed_total", `direction="`+dirMasterToSlave+`"`, stats.bytMasterToSlave.Load())
+	w.value("nvda_remote_bytes_relayed_total", `direction="`+dirSlaveToMaster+`"`, stats.bytSlaveToMaster.Load())
+	w.value("nvda_remote_bytes_relayed_total", `direction="`+dirOther+`"`, stats.bytOther.Load())
+	w.single("nvda_remote_nvda_not_connected_total", "counter", "nvda_not_connected responses sent to masters.", stats.notConnected.Load())
+	w.single("nvda_remote_auth_failures_total", "counter", "Clients disconnected after failing authorization.", stats.authFailures.Load())
+	w.single("nvda_remote_dropped_sends_total", "counter", "Messages dropped because the receiving client was closed.", stats.droppedSends.Load())
+	w.single("nvda_remote_tls_handshake_errors_total", "counter", "Failed TLS handshakes.", stats.handshakeErrors.Load())
+	w.single("nvda_remote_connections_denied_total", "counter", "Connections refused by the allow or deny list.", stats.denied.Load())
+	w.single("nvda_remote_send_queue_dropped_total", "counter", "Messages dropped because the receiving client's send queue was full.", stats.queueDropped.Load())
+	w.single("nvda_remote_send_queue_disconnects_total", "counter", "Clients disconnected because their send queue was full.", stats.queueDisconnects.Load())
+	w.single("nvda_remote_messages_too_large_total", "counter", "Clients disconnected for sending a message larger than the maximum message size.", stats.tooLarge.Load())
+	w.single("nvda_remote_banned_connections_total", "counter", "Connections refused because the IP address is banned.", stats.banned.Load())
+	w.single("nvda_remote_bans_total", "counter", "IP addresses banned after repeated authorization failures.", stats.bans.Load())
+	w.single("nvda_remote_bans_active", "gauge", "IP addresses currently banned.", uint64(len(bans.List())))
+	w.head("nvda_remote_auth_timeouts_total", "counter", "Clients disconnected for not joining a channel within the authentication timeout, by how far they got.")
+	w.value("nvda_remote_auth_timeouts_total", `stage="`+authStageHandshake+`"`, stats.authTimeoutHandshake.Load())
+	w.value("nvda_remote_auth_timeouts_total", `stage="`+authStageCommand+`"`, stats.authTimeoutCommand.Load())
+	w.value("nvda_remote_auth_timeouts_total", `stage="`+authStageJoin+`"`, stats.authTimeoutJoin.Load())
+	w.head("nvda_remote_idle_disconnects_total", "counter", "Clients removed from their channel for exceeding the idle timeout.")
+	w.value("nvda_remote_idle_disconnects_total", `connection_type="master"`, stats.idleMaster.Load())
+	w.value("nvda_remote_idle_disconnects_total", `connection_type="slave"`, stats.idleSlave.Load())
+	w.histogram("nvda_remote_join_duration_seconds", "Time from accepting a connection to the client joining its first channel.", joinTimeBuckets[:], &stats.joinTime)
+	w.head("nvda_remote_rate_limited_total", "counter", "Connections and commands refused by a per IP rate limit.")
+	w.value("nvda_remote_rate_limited_total", `limit="`+limitConnections+`"`, stats.limitConnections.Load())
+	w.value("nvda_remote_rate_limited_total", `limit="`+limitConnectionRate+`"`, stats.limitConnectionRate.Load())
+	w.value("nvda_remote_rate_limited_total", `limit="`+limitCommandRate+`"`, stats.limitCommandRate.Load())
+	return w.Bytes()
+}
+
+func metrics_listen(address string) error {
+	if address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(metrics_render())
+	})
+	hs := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(write_sec) * time.Second,
+	}
+	ml.Lock()
+	metrics_server = hs
+	ml.Unlock()
+	Log(LOG_DEBUG, "Serving metrics on address "+address)
+	go func() {
+		err := hs.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			Log_error("Metrics server at " + address + " has stopped.\r\n" + err.Error())
+		}
+	}()
+	go func() {
+		<-defaultHub.ctx.Done()
+		metrics_close()
+	}()
+	return nil
+}
+
+func metrics_close() {
+	ml.Lock()
+	defer ml.Unlock()
+	if metrics_server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(write_sec)*time.Second)
+	defer cancel()
+	_ = metrics_server.Shutdown(ctx)
+	metrics_server = nil
+}
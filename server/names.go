@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// A list of channels, given by the key used to join them.
+type NameList []string
+
+func (n *NameList) String() string {
+	if len(*n) == 0 {
+		return ""
+	}
+	return strings.Join(*n, "\n")
+}
+
+func (n *NameList) Set(v string) error {
+	if v == "" {
+		return errors.New("Empty channel name is invalid.")
+	}
+	*n = append(*n, v)
+	return nil
+}
+
+// Whether the list contains a channel. Entries are compared without any password, so the full key a client joins with can be given.
+func (n NameList) Contains(name string) bool {
+	for _, v := range n {
+		v, _, _ = getChannelParams(v)
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
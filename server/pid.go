@@ -2,9 +2,15 @@ package server
 
 import (
 	"os"
+	"sync"
 )
 
+// Held while the PID file is changed, which an upgrade and a shutdown can do at once.
+var pfl sync.Mutex
+
 func PidfileSet() {
+	pfl.Lock()
+	defer pfl.Unlock()
 	if pidfile == "" {
 		return
 	}
@@ -13,11 +19,25 @@ func PidfileSet() {
 	if err != nil {
 		Log(LOG_DEBUG, "Failed to write PID file.\n"+err.Error())
 		pidfile = ""
+		return
 	}
 	Log(LOG_DEBUG, "Successfully wrote PID file.")
 }
 
+// Forget the PID file without removing it, once another process has written its own PID to it.
+func PidfileRelease() {
+	pfl.Lock()
+	defer pfl.Unlock()
+	if pidfile == "" {
+		return
+	}
+	Log(LOG_DEBUG, "The PID file "+pidfile+" has been taken over by another process.")
+	pidfile = ""
+}
+
 func PidfileClear() {
+	pfl.Lock()
+	defer pfl.Unlock()
 	if pidfile == "" {
 		return
 	}
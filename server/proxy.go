@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The signature starting a version 2 PROXY protocol header.
+var proxy_v2_signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest a version 1 header can be, including the line ending.
+const proxy_v1_max int = 107
+
+var errProxyHeader = errors.New("The PROXY protocol header is invalid.")
+
+func (h *Hub) proxyTrusted() netList {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return h.proxyNets
+}
+
+// Accepts connections from a load balancer, reading each PROXY protocol header in its own goroutine.
+type proxyListener struct {
+	net.Listener
+	address string
+	hub     *Hub
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	// Set before failed is closed, once the listener is unable to accept any more connections.
+	err    error
+	failed chan struct{}
+}
+
+func proxy_listen(h *Hub, l net.Listener, address string) *proxyListener {
+	pl := &proxyListener{
+		Listener: l,
+		address:  address,
+		hub:      h,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+	go pl.accept()
+	return pl
+}
+
+func (pl *proxyListener) accept() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			pl.err = err
+			close(pl.failed)
+			return
+		}
+		go pl.handle(conn)
+	}
+}
+
+func (pl *proxyListener) handle(conn net.Conn) {
+	ip := getIP(conn)
+	if !pl.hub.proxyTrusted().Contains(ip) {
+		pl.hub.stats.denied.Add(1)
+		pl.hub.audit(auditEntry{Event: "connection_denied", IP: ip, Reason: "it is not a trusted proxy"})
+		pl.hub.Log(pl.hub.accessSettings().logLevel, "Connection from "+ip+" to the server at "+pl.address+" has been denied, because it is not a trusted proxy.")
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Duration(write_sec) * time.Second))
+	pc, err := proxy_read(conn)
+	if err != nil {
+		pl.hub.Log(LOG_DEBUG, "Unable to read the PROXY protocol header from "+ip+" on the server at "+pl.address+". Closing the connection.\r\n"+err.Error())
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	select {
+	case pl.conns <- pc:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.failed:
+		return nil, pl.err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	pl.once.Do(func() {
+		close(pl.done)
+	})
+	return pl.Listener.Close()
+}
+
+// A connection from a proxy, reporting the address of the client the proxy accepted it from.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// Read a version 1 or 2 PROXY protocol header.
+func proxy_read(conn net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+	}
+	// Only enough to tell the versions apart is read, since a version 1 header can be shorter than the version 2 signature.
+	sig, err := pc.r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	switch {
+	case bytes.Equal(sig, proxy_v2_signature[:5]):
+		addr, err = proxy_read_v2(pc.r)
+	case bytes.Equal(sig, []byte("PROXY")):
+		addr, err = proxy_read_v1(pc.r)
+	default:
+		return nil, errors.New("The connection didn't start with a PROXY protocol header.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		pc.remote = addr
+	}
+	return pc, nil
+}
+
+// Read a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 6837\r\n".
+func proxy_read_v1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxy_v1_max)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxy_v1_max {
+			return nil, errProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if f[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(f[2])
+	if ip == nil || (f[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Read a binary header, skipping any extensions after the addresses.
+func proxy_read_v2(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:12], proxy_v2_signature) || h[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	command := h[12] & 0x0f
+	family := h[13] >> 4
+	length := int(binary.BigEndian.Uint16(h[14:]))
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0x0:
+		// A health check from the proxy itself.
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, errProxyHeader
+	}
+	switch family {
+	case 0x1:
+		if length < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(b[0:4]), Port: int(binary.BigEndian.Uint16(b[8:10]))}, nil
+	case 0x2:
+		if length < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(b[0:16]), Port: int(binary.BigEndian.Uint16(b[32:34]))}, nil
+	}
+	// Unix sockets and unspecified addresses.
+	return nil, nil
+}
+
+func proxy_check(list AddressList, trusted CIDRList) {
+	if len(list) == 0 {
+		return
+	}
+	if len(trusted) == 0 {
+		Log(LOG_INFO, "Addresses have been chosen to accept the PROXY protocol, but no trusted proxies have been given. Every connection to them will be refused until the proxy-trust parameter is set.")
+		return
+	}
+	Log(LOG_DEBUG, "The PROXY protocol will be accepted on "+addresses_string(list)+" from "+addresses_string(AddressList(trusted)))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Build a version 2 header with the given command, address family and addresses.
+func proxy_v2(command, family byte, body []byte) []byte {
+	h := append([]byte(nil), proxy_v2_signature...)
+	h = append(h, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(body)))
+	return append(h, body...)
+}
+
+func proxy_v2_tcp4(src, dst string, sport, dport uint16) []byte {
+	b := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func proxy_v2_tcp6(src, dst string, sport, dport uint16) []byte {
+	b := append(net.ParseIP(src).To16(), net.ParseIP(dst).To16()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestProxyRead(t *testing.T) {
+	v1Padded := "PROXY UNKNOWN" + strings.Repeat(" ", proxy_v1_max-len("PROXY UNKNOWN\r\n")) + "\r\n"
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		// The address the connection reports, or an empty string if it keeps the address of the proxy.
+		addr string
+		// Whether the header is written and the connection closed, rather than kept open after the header.
+		closed bool
+		valid  bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 6837\r\n"), "192.0.2.1:56324", false, true},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 6837\r\n"), "[2001:db8::1]:56324", false, true},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false, true},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 6837\r\n"), "", false, true},
+		{"v1 longest", []byte(v1Padded), "", false, true},
+		{"v1 too long", []byte(v1Padded[:len(v1Padded)-2] + " \r\n"), "", false, false},
+		{"v1 no end", []byte(strings.Repeat("PROXY ", 30)), "", false, false},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51"), "", true, false},
+		{"v1 no carriage return", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 6837\n"), "", false, false},
+		{"v1 tcp4 with ipv6", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 6837\r\n"), "", false, false},
+		{"v1 tcp6 with ipv4", []byte("PROXY TCP6 192.0.2.1 198.51.100.1 56324 6837\r\n"), "", false, false},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 6837\r\n"), "", false, false},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 6837\r\n"), "", false, false},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), "", false, false},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 6837\r\n"), "", false, false},
+		{"v1 misspelled", []byte("PROXYTCP4 192.0.2.1 198.51.100.1 56324 6837\r\n"), "", false, false},
+		{"v2 ipv4", proxy_v2(0x1, 0x1, proxy_v2_tcp4("192.0.2.1", "198.51.100.1", 56324, 6837)), "192.0.2.1:56324", false, true},
+		{"v2 ipv6", proxy_v2(0x1, 0x2, proxy_v2_tcp6("2001:db8::1", "2001:db8::2", 56324, 6837)), "[2001:db8::1]:56324", false, true},
+		{"v2 extensions", proxy_v2(0x1, 0x1, append(proxy_v2_tcp4("192.0.2.1", "198.51.100.1", 56324, 6837), 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:56324", false, true},
+		{"v2 local", proxy_v2(0x0, 0x0, nil), "", false, true},
+		{"v2 local with addresses", proxy_v2(0x0, 0x1, proxy_v2_tcp4("192.0.2.1", "198.51.100.1", 56324, 6837)), "", false, true},
+		{"v2 unspecified", proxy_v2(0x1, 0x0, nil), "", false, true},
+		{"v2 ipv4 too short", proxy_v2(0x1, 0x1, make([]byte, 8)), "", false, false},
+		{"v2 ipv4 family with ipv6 length", proxy_v2(0x1, 0x2, proxy_v2_tcp4("192.0.2.1", "198.51.100.1", 56324, 6837)), "", false, false},
+		{"v2 unknown command", proxy_v2(0x2, 0x1, proxy_v2_tcp4("192.0.2.1", "198.51.100.1", 56324, 6837)), "", false, false},
+		{"v2 wrong version", append(append([]byte(nil), proxy_v2_signature...), 0x11, 0x11, 0, 0), "", false, false},
+		{"v2 signature mismatch", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), "", false, false},
+		{"v2 truncated header", proxy_v2_signature[:10], "", true, false},
+		{"v2 truncated addresses", proxy_v2(0x1, 0x1, proxy_v2_tcp4("192.0.2.1", "198.51.100.1", 56324, 6837))[:20], "", true, false},
+		{"v2 length past the end", append(proxy_v2(0x1, 0x1, nil)[:14], 0xff, 0xff), "", true, false},
+		{"no header", []byte("{\"type\":\"protocol_version\"}\n"), "", false, false},
+		{"too short to tell", []byte("PRO"), "", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local, peer := net.Pipe()
+			defer local.Close()
+			defer peer.Close()
+			header, closed := tc.header, tc.closed
+			go func() {
+				_, _ = peer.Write(header)
+				if closed {
+					peer.Close()
+					return
+				}
+				_, _ = peer.Write([]byte("data"))
+			}()
+			_ = local.SetReadDeadline(time.Now().Add(2 * time.Second))
+			start := time.Now()
+			pc, err := proxy_read(local)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("Reading the header took %v.", elapsed)
+			}
+			if !tc.valid {
+				if err == nil {
+					t.Fatalf("The header was accepted, with the address %v.", pc.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := tc.addr
+			if addr == "" {
+				addr = local.RemoteAddr().String()
+			}
+			if got := pc.RemoteAddr().String(); got != addr {
+				t.Fatalf("Expected the address %s, got %s.", addr, got)
+			}
+			// Whatever follows the header is left to be read from the connection.
+			b := make([]byte, 4)
+			if _, err = io.ReadFull(pc, b); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, []byte("data")) {
+				t.Fatalf("Expected the data after the header, got %q.", b)
+			}
+		})
+	}
+}
+
+// A health check can be shorter than the version 2 signature, and nothing follows it until the proxy closes the connection.
+func TestProxyReadHealthCheck(t *testing.T) {
+	for _, header := range [][]byte{[]byte("PROXY UNKNOWN\r\n"), proxy_v2(0x0, 0x0, nil)} {
+		local, peer := net.Pipe()
+		go func() {
+			_, _ = peer.Write(header)
+		}()
+		_ = local.SetReadDeadline(time.Now().Add(2 * time.Second))
+		start := time.Now()
+		_, err := proxy_read(local)
+		elapsed := time.Since(start)
+		local.Close()
+		peer.Close()
+		if err != nil {
+			t.Fatalf("Unable to read %q: %v", header, err)
+		}
+		if elapsed > time.Second {
+			t.Fatalf("Reading %q took %v.", header, elapsed)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ratelimit_sweep_sec int = 60
+
+const (
+	limitConnections    string = "connections"
+	limitConnectionRate string = "connection_rate"
+	limitCommandRate    string = "command_rate"
+)
+
+type limitSettings struct {
+	maxConns       int
+	connsPerMinute int
+	cmdsPerMinute  int
+	exempt         netList
+}
+
+func (h *Hub) limits() limitSettings {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return limitSettings{
+		maxConns:       h.opts.MaxConnsPerIP,
+		connsPerMinute: h.opts.ConnsPerMinute,
+		cmdsPerMinute:  h.opts.CmdsPerMinute,
+		exempt:         h.exemptNets,
+	}
+}
+
+// A token bucket holding up to one minute of tokens, refilled continuously.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(perMinute int, now time.Time) bool {
+	if perMinute <= 0 {
+		return true
+	}
+	b.fill(perMinute, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) fill(perMinute int, now time.Time) {
+	limit := float64(perMinute)
+	if b.last.IsZero() {
+		b.tokens = limit
+	} else {
+		b.tokens += now.Sub(b.last).Minutes() * limit
+		if b.tokens > limit {
+			b.tokens = limit
+		}
+	}
+	b.last = now
+}
+
+func (b *bucket) full(perMinute int, now time.Time) bool {
+	if perMinute <= 0 || b.last.IsZero() {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Minutes()*float64(perMinute) >= float64(perMinute)
+}
+
+type ipLimit struct {
+	conns    int
+	connect  bucket
+	commands bucket
+	// The limit that was last exceeded, so a flood of refusals is only logged once.
+	tripped string
+}
+
+// Limits for each IP address connecting to a single listener.
+type rateLimiter struct {
+	sync.Mutex
+	address string
+	ips     map[string]*ipLimit
+	hub     *Hub
+}
+
+func newRateLimiter(h *Hub, address string) *rateLimiter {
+	return &rateLimiter{
+		hub:     h,
+		address: address,
+		ips:     make(map[string]*ipLimit),
+	}
+}
+
+func (r *rateLimiter) get(ip string) *ipLimit {
+	l, exists := r.ips[ip]
+	if !exists {
+		l = &ipLimit{}
+		r.ips[ip] = l
+	}
+	return l
+}
+
+// Register a new connection, returning false if it must be refused.
+func (r *rateLimiter) connect(ip string) bool {
+	ls := r.hub.limits()
+	if ls.exempt.Contains(ip) {
+		return true
+	}
+	r.Lock()
+	defer r.Unlock()
+	l := r.get(ip)
+	if ls.maxConns > 0 && l.conns >= ls.maxConns {
+		r.trip(ip, l, limitConnections, &r.hub.stats.limitConnections, "has reached the limit of "+strconv.Itoa(ls.maxConns)+" concurrent connections")
+		return false
+	}
+	if !l.connect.take(ls.connsPerMinute, time.Now()) {
+		r.trip(ip, l, limitConnectionRate, &r.hub.stats.limitConnectionRate, "has exceeded the limit of "+strconv.Itoa(ls.connsPerMinute)+" new connections per minute")
+		return false
+	}
+	l.conns++
+	l.tripped = ""
+	return true
+}
+
+func (r *rateLimiter) disconnect(ip string) {
+	r.Lock()
+	defer r.Unlock()
+	l, exists := r.ips[ip]
+	if !exists || l.conns == 0 {
+		return
+	}
+	l.conns--
+}
+
+// Count a command received before joining a channel, returning false if the client must be disconnected.
+func (r *rateLimiter) command(ip string) bool {
+	ls := r.hub.limits()
+	if ls.cmdsPerMinute <= 0 || ls.exempt.Contains(ip) {
+		return true
+	}
+	r.Lock()
+	defer r.Unlock()
+	l := r.get(ip)
+	if !l.commands.take(ls.cmdsPerMinute, time.Now()) {
+		r.trip(ip, l, limitCommandRate, &r.hub.stats.limitCommandRate, "has exceeded the limit of "+strconv.Itoa(ls.cmdsPerMinute)+" commands per minute before joining a channel")
+		return false
+	}
+	if l.tripped == limitCommandRate {
+		l.tripped = ""
+	}
+	return true
+}
+
+func (r *rateLimiter) trip(ip string, l *ipLimit, limit string, count *atomic.Uint64, reason string) {
+	count.Add(1)
+	if l.tripped == limit {
+		return
+	}
+	l.tripped = limit
+	r.hub.Log(LOG_CONNECTION, "Rate limit exceeded on the server at "+r.address+". The IP address "+ip+" "+reason+". Further connections or commands from this address will be refused until the limit has been reset.")
+}
+
+// Forget addresses with no connections whose limits have fully recovered.
+func (r *rateLimiter) sweep() {
+	ls := r.hub.limits()
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	for ip, l := range r.ips {
+		if l.conns > 0 || !l.connect.full(ls.connsPerMinute, now) || !l.commands.full(ls.cmdsPerMinute, now) {
+			continue
+		}
+		delete(r.ips, ip)
+	}
+}
+
+func (r *rateLimiter) watch(ctx context.Context) {
+	t := time.NewTicker(time.Duration(ratelimit_sweep_sec) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			r.sweep()
+		}
+	}
+}
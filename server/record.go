@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const record_motd string = "WARNING!\nThis channel is being recorded for debugging, including everything sent between computers, such as keystrokes and speech."
+
+const record_version int = 1
+
+// Most entries waiting to be written to a recording before further entries are dropped.
+const record_queue int = 1024
+
+// The first line of a recording.
+type recordHeader struct {
+	Version int    `json:"version"`
+	Channel string `json:"channel"`
+	Start   string `json:"start"`
+}
+
+// A message passing through a recorded channel. T is in milliseconds, and From is 0 for the server.
+type recordEntry struct {
+	T              int64           `json:"t"`
+	From           int             `json:"from,omitempty"`
+	ConnectionType string          `json:"ct,omitempty"`
+	To             []int           `json:"to"`
+	M              json.RawMessage `json:"m,omitempty"`
+	Raw            string          `json:"raw,omitempty"`
+}
+
+// Records every message sent through a channel to a file, one line of JSON each.
+type recorder struct {
+	sync.Mutex
+	f       *os.File
+	start   time.Time
+	secrets []string
+	redact  redaction
+	// The hub failures to write the recording are logged through.
+	hub     *Hub
+	entries chan []byte
+	closed  bool
+	// Set once an entry has been dropped because too many were waiting, until one is queued again.
+	dropping bool
+}
+
+func (h *Hub) recordSettings() (string, NameList) {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return h.opts.RecordDir, h.opts.RecordChannels
+}
+
+// Start recording a channel if it has been chosen for recording, returning nil if it hasn't.
+func (h *Hub) recordStart(name, password string) *recorder {
+	dir, channels := h.recordSettings()
+	if dir == "" || !channels.Contains(name) {
+		return nil
+	}
+	r, err := record_open(h, dir, name, password)
+	if err != nil {
+		h.Log_error("Unable to record channel "+h.secret(name)+".\r\n"+err.Error(), log_fields("record_error").Channel(name))
+		return nil
+	}
+	h.Log(LOG_INFO, "Channel "+h.secret(name)+" is being recorded to "+r.f.Name(), log_fields("record_started").Channel(name))
+	h.audit(auditEntry{Event: "recording_started", Channel: name, Reason: r.f.Name()})
+	return r
+}
+
+// Create a new recording in dir, named after the time it started.
+func record_open(h *Hub, dir, name, password string) (*recorder, error) {
+	rd := h.redact()
+	dir = fullPath(dir)
+	// Recordings hold everything sent through a channel, so only the user the server is running under can read them.
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	base := filepath.Join(dir, start.Format(log_rotate_format))
+	file := base + ".jsonl"
+	var f *os.File
+	for i := 2; ; i++ {
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if !errors.Is(err, fs.ErrExist) || i > 100 {
+			break
+		}
+		file = base + "-" + strconv.Itoa(i) + ".jsonl"
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{
+		f:       f,
+		start:   start,
+		secrets: []string{name, password},
+		redact:  rd,
+		hub:     h,
+		entries: make(chan []byte, record_queue),
+	}
+	b, err := json.Marshal(recordHeader{
+		Version: record_version,
+		Channel: rd.secret(name),
+		Start:   start.Format(time.RFC3339Nano),
+	})
+	if err == nil {
+		_, err = f.Write(append(b, '\n'))
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	h.recs.Add(1)
+	go r.write()
+	return r, nil
+}
+
+// Write entries as they are queued, until the recorder is closed.
+func (r *recorder) write() {
+	defer r.hub.recs.Done()
+	w := bufio.NewWriter(r.f)
+	failing := false
+	for b := range r.entries {
+		_, err := w.Write(b)
+		if err == nil && len(r.entries) == 0 {
+			err = w.Flush()
+		}
+		if err != nil && !failing {
+			failing = true
+			r.hub.Log_error("Unable to write to the recording " + r.f.Name() + ".\r\n" + err.Error())
+		}
+	}
+	_ = w.Flush()
+	_ = r.f.Sync()
+	_ = r.f.Close()
+}
+
+// Add a message to the recording. It is safe to call on a nil recorder, which records nothing.
+func (r *recorder) Record(from int, ctype string, to []int, msg []byte) {
+	if r == nil {
+		return
+	}
+	if to == nil {
+		to = []int{}
+	}
+	sort.Ints(to)
+	e := recordEntry{
+		From:           from,
+		ConnectionType: ctype,
+		To:             to,
+	}
+	m := r.redact.protocol(msg, r.secrets...)
+	if json.Valid([]byte(m)) {
+		e.M = json.RawMessage(m)
+	} else {
+		e.Raw = m
+	}
+	e.T = time.Since(r.start).Milliseconds()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.entries <- append(b, '\n'):
+		r.dropping = false
+	default:
+		if !r.dropping {
+			r.dropping = true
+			r.hub.Log_error("The recording " + r.f.Name() + " can't be written quickly enough. Messages are being left out of it.")
+		}
+	}
+}
+
+func (r *recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.entries)
+}
+
+func record_check(dir string, channels NameList) {
+	if len(channels) == 0 {
+		return
+	}
+	if dir == "" {
+		Log(LOG_INFO, "Channels have been chosen for recording, but no directory has been given to record them in. No channels will be recorded.")
+		return
+	}
+	Log(LOG_INFO, strconv.Itoa(len(channels))+" channels will be recorded in "+fullPath(dir)+". Clients joining them will be warned through the message of the day.")
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecordWrite(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LogLevel = LOG_SILENT
+	h := NewHub(opts)
+	h.SetLogger(&hubTestLogger{})
+	dir := t.TempDir()
+	r, err := record_open(h, dir, "channel", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Record(1, connTypeMaster, []int{2}, []byte(`{"type":"join","channel":"channel"}`))
+	num := record_queue * 2
+	for i := 0; i < num; i++ {
+		r.Record(1, connTypeMaster, []int{2}, []byte(`{"type":"key","n":`+strconv.Itoa(i)+`}`))
+	}
+	r.Close()
+	// Entries recorded after the recording is closed are left out, rather than panicking.
+	r.Record(1, connTypeMaster, []int{2}, []byte(`{"type":"key"}`))
+	h.Wait()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one recording, got %v: %v", files, err)
+	}
+	header, entries, err := replay_read(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Channel == "channel" {
+		t.Fatal("The channel name wasn't hidden in the header.")
+	}
+	// Entries can be dropped if they are recorded faster than they are written, but the order is kept.
+	if len(entries) == 0 || len(entries) > num+1 {
+		t.Fatalf("Expected up to %d entries, got %d.", num+1, len(entries))
+	}
+	last := -1
+	for _, e := range entries[1:] {
+		s := string(e.M)
+		n, err := strconv.Atoi(s[strings.LastIndex(s, ":")+1 : len(s)-1])
+		if err != nil || n <= last {
+			t.Fatalf("Entry %s is out of order after entry %d.", s, last)
+		}
+		last = n
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"channel":"channel"`) {
+		t.Fatal("The channel name wasn't hidden in a recorded message.")
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+const (
+	REDACT_MASK string = "mask"
+	REDACT_HASH string = "hash"
+)
+
+const redact_mask string = "[redacted]"
+
+// Fields of protocol messages that hold secrets. The channel field holds the channel key, along with the password of a locked channel.
+var redact_fields = map[string]bool{
+	"channel": true,
+	"key":     true,
+}
+
+// Key for hashing secrets, generated at startup.
+var redactKey = redact_key()
+
+func redact_key() []byte {
+	k := make([]byte, 32)
+	_, _ = rand.Read(k)
+	return k
+}
+
+// How secrets are hidden in log messages, from the settings of a hub.
+type redaction struct {
+	secrets bool
+	mode    string
+}
+
+func (h *Hub) redact() redaction {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return redaction{secrets: h.opts.LogSecrets, mode: h.opts.LogRedact}
+}
+
+// Hide a secret, such as a channel key or password, before it is logged by this hub.
+func (h *Hub) secret(s string) string {
+	return h.redact().secret(s)
+}
+
+// Hide a secret in a message logged by the package rather than a hub, using the settings of the hub started by Start.
+func log_secret(s string) string {
+	return defaultHub.secret(s)
+}
+
+func (r redaction) secret(s string) string {
+	if s == "" || r.secrets {
+		return s
+	}
+	if r.mode == REDACT_HASH {
+		m := hmac.New(sha256.New, redactKey)
+		m.Write([]byte(s))
+		return "[redacted " + hex.EncodeToString(m.Sum(nil))[:12] + "]"
+	}
+	return redact_mask
+}
+
+// Hide secrets in a protocol message before it is logged.
+func (r redaction) protocol(b []byte, secrets ...string) string {
+	if r.secrets {
+		return string(b)
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(b, &m) != nil {
+		return string(b)
+	}
+	var rp *strings.Replacer
+	changed := false
+	for k, v := range m {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			continue
+		}
+		if redact_fields[k] {
+			m[k] = r.secret(s)
+			changed = true
+			continue
+		}
+		if rp == nil {
+			rp = r.replacer(secrets)
+		}
+		if rs := rp.Replace(s); rs != s {
+			m[k] = rs
+			changed = true
+		}
+	}
+	if !changed {
+		return string(b)
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(m) != nil {
+		return redact_mask
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// Replace every secret at once, longest first.
+func (r redaction) replacer(secrets []string) *strings.Replacer {
+	s := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			s = append(s, secret)
+		}
+	}
+	sort.Slice(s, func(i, j int) bool {
+		return len(s[i]) > len(s[j])
+	})
+	pairs := make([]string, 0, len(s)*2)
+	for _, secret := range s {
+		pairs = append(pairs, secret, r.secret(secret))
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+func log_redact_check(h *Hub, secrets bool, mode string) string {
+	switch mode {
+	case REDACT_MASK, REDACT_HASH:
+	default:
+		h.Log(LOG_INFO, "The log redaction mode \""+mode+"\" is invalid. It must be "+REDACT_MASK+" or "+REDACT_HASH+". Resetting to "+DEFAULT_LOG_REDACT)
+		mode = DEFAULT_LOG_REDACT
+	}
+	if secrets {
+		h.Log(LOG_INFO, "Channel keys, passwords, and generated keys will be logged without being hidden. Only use this for debugging.")
+	}
+	return mode
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"crypto/tls"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tech10/nvdaRemoteServer/signals"
+)
+
+// Protects the settings that can be changed while the server is running.
+var rl sync.RWMutex
+
+var (
+	// Configuration as given on the command line and in the configuration file, before any checks were applied.
+	runCfg *Cfg
+	// Parameters explicitly given on the command line, which take priority over a reloaded configuration file.
+	flagsSet  = make(map[string]bool)
+	tlsConfig *tls.Config
+)
+
+// How a setting is handled when the configuration is reloaded.
+const (
+	// Logged when it changes, and applied along with the rest of the settings.
+	reloadApply int = iota
+	// Can only be changed by restarting the server.
+	reloadRestart
+	// Handled on its own by Reload.
+	reloadSelf
+)
+
+type cfgSetting struct {
+	// The name in the configuration file.
+	name string
+	// The command line parameter that takes priority over the configuration file.
+	flag   string
+	value  func(*Cfg) interface{}
+	reload int
+	// Called after a change has been logged, with the running and new configuration.
+	apply func(o, n *Cfg)
+}
+
+var cfgSettings = []cfgSetting{
+	{"pid_file", "pid-file", func(c *Cfg) interface{} { return &c.PidFile }, reloadRestart, nil},
+	{"log_file", "log-file", func(c *Cfg) interface{} { return &c.LogFile }, reloadApply, reload_log_file},
+	{"log_format", "log-format", func(c *Cfg) interface{} { return &c.LogFormat }, reloadApply, nil},
+	{"log_max_size", "log-max-size", func(c *Cfg) interface{} { return &c.LogMaxSize }, reloadApply, nil},
+	{"log_max_age", "log-max-age", func(c *Cfg) interface{} { return &c.LogMaxAge }, reloadApply, nil},
+	{"log_max_files", "log-max-files", func(c *Cfg) interface{} { return &c.LogMaxFiles }, reloadApply, nil},
+	{"log_compress", "log-compress", func(c *Cfg) interface{} { return &c.LogCompress }, reloadApply, nil},
+	{"log_secrets", "log-secrets", func(c *Cfg) interface{} { return &c.LogSecrets }, reloadApply, nil},
+	{"log_redact", "log-redact", func(c *Cfg) interface{} { return &c.LogRedact }, reloadApply, nil},
+	{"log_level", "log-level", func(c *Cfg) interface{} { return &c.LogLevel }, reloadApply, nil},
+	{"motd", "motd", func(c *Cfg) interface{} { return &c.Motd }, reloadApply, nil},
+	{"motd_always_display", "motd-always-display", func(c *Cfg) interface{} { return &c.MotdAlwaysDisplay }, reloadApply, nil},
+	{"send_origin", "send-origin", func(c *Cfg) interface{} { return &c.SendOrigin }, reloadApply, func(o, n *Cfg) { send_origin_check(n.SendOrigin) }},
+	{"max_connections_per_ip", "max-connections-per-ip", func(c *Cfg) interface{} { return &c.MaxConnsPerIP }, reloadApply, nil},
+	{"connections_per_minute", "connections-per-minute", func(c *Cfg) interface{} { return &c.ConnsPerMinute }, reloadApply, nil},
+	{"commands_per_minute", "commands-per-minute", func(c *Cfg) interface{} { return &c.CmdsPerMinute }, reloadApply, nil},
+	{"ratelimit_exempt", "ratelimit-exempt", func(c *Cfg) interface{} { return &c.RatelimitExempt }, reloadApply, nil},
+	{"allow", "allow", func(c *Cfg) interface{} { return &c.Allow }, reloadApply, nil},
+	{"deny", "deny", func(c *Cfg) interface{} { return &c.Deny }, reloadApply, nil},
+	{"proxy_trust", "proxy-trust", func(c *Cfg) interface{} { return &c.ProxyTrust }, reloadApply, func(o, n *Cfg) { proxy_check(n.ProxyProtocol, n.ProxyTrust) }},
+	{"deny_log_level", "deny-log-level", func(c *Cfg) interface{} { return &c.DenyLogLevel }, reloadApply, nil},
+	{"max_auth_message_size", "max-auth-message-size", func(c *Cfg) interface{} { return &c.MaxAuthMsgSize }, reloadApply, nil},
+	{"max_message_size", "max-message-size", func(c *Cfg) interface{} { return &c.MaxMsgSize }, reloadApply, nil},
+	{"auth_timeout", "auth-timeout", func(c *Cfg) interface{} { return &c.AuthTimeout }, reloadApply, nil},
+	{"upgrade_timeout", "upgrade-timeout", func(c *Cfg) interface{} { return &c.UpgradeTimeout }, reloadApply, nil},
+	{"drain_time", "drain-time", func(c *Cfg) interface{} { return &c.DrainTime }, reloadApply, nil},
+	{"idle_timeout_master", "idle-timeout-master", func(c *Cfg) interface{} { return &c.IdleTimeoutMaster }, reloadApply, nil},
+	{"idle_timeout_slave", "idle-timeout-slave", func(c *Cfg) interface{} { return &c.IdleTimeoutSlave }, reloadApply, nil},
+	{"send_queue_depth", "send-queue-depth", func(c *Cfg) interface{} { return &c.SendQueueDepth }, reloadApply, nil},
+	{"send_queue_policy", "send-queue-policy", func(c *Cfg) interface{} { return &c.SendQueuePolicy }, reloadApply, nil},
+	{"send_queue_timeout", "send-queue-timeout", func(c *Cfg) interface{} { return &c.SendQueueTimeout }, reloadApply, nil},
+	{"ban_failures", "ban-failures", func(c *Cfg) interface{} { return &c.BanFailures }, reloadApply, nil},
+	{"ban_window", "ban-window", func(c *Cfg) interface{} { return &c.BanWindow }, reloadApply, nil},
+	{"ban_time", "ban-time", func(c *Cfg) interface{} { return &c.BanTime }, reloadApply, nil},
+	{"ban_max_time", "ban-max-time", func(c *Cfg) interface{} { return &c.BanMaxTime }, reloadApply, nil},
+	{"record_dir", "record-dir", func(c *Cfg) interface{} { return &c.RecordDir }, reloadApply, nil},
+	{"record_channels", "record-channel", func(c *Cfg) interface{} { return &c.RecordChannels }, reloadApply, func(o, n *Cfg) {
+		Log(LOG_INFO, "Channels already being recorded will be recorded until they are removed.")
+	}},
+	{"addresses", "address", func(c *Cfg) interface{} { return &c.Addresses }, reloadSelf, nil},
+	{"cert_file", "cert-file", func(c *Cfg) interface{} { return &c.Cert }, reloadSelf, nil},
+	{"key_file", "key-file", func(c *Cfg) interface{} { return &c.Key }, reloadSelf, nil},
+	{"admin_socket", "admin-socket", func(c *Cfg) interface{} { return &c.AdminSocket }, reloadRestart, nil},
+	{"websocket_address", "websocket-address", func(c *Cfg) interface{} { return &c.WebSocketAddress }, reloadRestart, nil},
+	{"websocket_path", "websocket-path", func(c *Cfg) interface{} { return &c.WebSocketPath }, reloadRestart, nil},
+	{"proxy_protocol", "proxy-protocol", func(c *Cfg) interface{} { return &c.ProxyProtocol }, reloadRestart, nil},
+	{"metrics_address", "metrics-address", func(c *Cfg) interface{} { return &c.MetricsAddress }, reloadRestart, nil},
+	{"acme_domains", "acme-domain", func(c *Cfg) interface{} { return &c.AcmeDomains }, reloadRestart, nil},
+	{"acme_email", "acme-email", func(c *Cfg) interface{} { return &c.AcmeEmail }, reloadRestart, nil},
+	{"acme_directory", "acme-directory", func(c *Cfg) interface{} { return &c.AcmeDirectory }, reloadRestart, nil},
+	{"acme_cache_dir", "acme-cache-dir", func(c *Cfg) interface{} { return &c.AcmeCacheDir }, reloadRestart, nil},
+	{"acme_http_address", "acme-http-address", func(c *Cfg) interface{} { return &c.AcmeHTTPAddress }, reloadRestart, nil},
+	{"acme_ca_file", "acme-ca-file", func(c *Cfg) interface{} { return &c.AcmeCAFile }, reloadRestart, nil},
+	{"log_sink", "log-sink", func(c *Cfg) interface{} { return &c.LogSink }, reloadRestart, nil},
+	{"log_sink_ca_file", "log-sink-ca-file", func(c *Cfg) interface{} { return &c.LogSinkCAFile }, reloadRestart, nil},
+	{"ban_file", "ban-file", func(c *Cfg) interface{} { return &c.BanFile }, reloadRestart, nil},
+	{"audit_file", "audit-file", func(c *Cfg) interface{} { return &c.AuditFile }, reloadRestart, nil},
+	{"audit_key_file", "audit-key-file", func(c *Cfg) interface{} { return &c.AuditKeyFile }, reloadRestart, nil},
+}
+
+// A setting's value as it is logged. Channel names are the keys used to join them, so only the number of channels is logged.
+func cfg_string(v interface{}) string {
+	switch v := v.(type) {
+	case *string:
+		return "\"" + *v + "\""
+	case *int:
+		return strconv.Itoa(*v)
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *AddressList:
+		return addresses_string(*v)
+	case *CIDRList:
+		return addresses_string(AddressList(*v))
+	case *DomainList:
+		return addresses_string(AddressList(*v))
+	case *NameList:
+		return strconv.Itoa(len(*v)) + " channels"
+	}
+	return ""
+}
+
+func cfg_equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *string:
+		return *a == *b.(*string)
+	case *int:
+		return *a == *b.(*int)
+	case *bool:
+		return *a == *b.(*bool)
+	case *AddressList:
+		return addresses_equal(*a, *b.(*AddressList))
+	case *CIDRList:
+		return addresses_equal(AddressList(*a), AddressList(*b.(*CIDRList)))
+	case *DomainList:
+		return addresses_equal(AddressList(*a), AddressList(*b.(*DomainList)))
+	case *NameList:
+		return addresses_equal(AddressList(*a), AddressList(*b.(*NameList)))
+	}
+	return false
+}
+
+// Set the setting n points to to the one o points to.
+func cfg_keep(n, o interface{}) {
+	switch n := n.(type) {
+	case *string:
+		*n = *o.(*string)
+	case *int:
+		*n = *o.(*int)
+	case *bool:
+		*n = *o.(*bool)
+	case *AddressList:
+		*n = *o.(*AddressList)
+	case *CIDRList:
+		*n = *o.(*CIDRList)
+	case *DomainList:
+		*n = *o.(*DomainList)
+	case *NameList:
+		*n = *o.(*NameList)
+	}
+}
+
+func reload_log_file(o, n *Cfg) {
+	err := log_reopen(n.LogFile)
+	if err != nil {
+		Log_error("Unable to open log file " + n.LogFile + " for writing. Continuing to log to " + o.LogFile + "\r\n" + err.Error())
+		n.LogFile = o.LogFile
+	}
+}
+
+func log_get() (int, string) {
+	rl.RLock()
+	defer rl.RUnlock()
+	return loglevel, logFormat
+}
+
+func flags_record() {
+	flag.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+}
+
+// Wait until every server started by Start has stopped.
+func Wait() {
+	defaultHub.Wait()
+}
+
+func reload_init() {
+	hup := signals.Reload()
+	for {
+		select {
+		case <-defaultHub.ctx.Done():
+			return
+		case sig := <-hup:
+			Log(LOG_INFO, "Signal received to reload configuration. Received signal "+sig.String())
+			Reload()
+		}
+	}
+}
+
+// Re-read the configuration file, applying anything that can be changed while the server is running.
+func Reload() {
+	if upgrade_done() {
+		Log(LOG_INFO, "This process has been replaced by an upgrade, and is only serving its remaining clients. Its configuration won't be reloaded.")
+		return
+	}
+	if !default_conf_read(confRead) {
+		Log(LOG_INFO, "No configuration file is being read. Only the certificate will be reloaded.")
+		certs.reload_log()
+		return
+	}
+	c := cfg_default()
+	err := c.Read()
+	c.LogWrite()
+	if err != nil {
+		Log_error("Unable to reload the configuration file. The current configuration will remain in use.\r\n" + err.Error())
+		return
+	}
+	o := runCfg
+	n := cfg_merge(o, c)
+	changes := 0
+
+	for _, st := range cfgSettings {
+		if st.reload != reloadApply || cfg_equal(st.value(n), st.value(o)) {
+			continue
+		}
+		changes++
+		Log(LOG_INFO, st.name+" changed from "+cfg_string(st.value(o))+" to "+cfg_string(st.value(n)))
+		if st.apply != nil {
+			st.apply(o, n)
+		}
+	}
+	format := log_format_check(n.LogFormat)
+	lMaxSize, lMaxAge, lMaxFiles := log_rotate_check(n.LogMaxSize, n.LogMaxAge, n.LogMaxFiles)
+	level := log_level_check(defaultHub, n.LogLevel)
+	opts := n.Options()
+	opts.LogLevel = level
+	opts.Motd, opts.MotdAlwaysDisplay = motd_check(n.Motd, n.MotdAlwaysDisplay, level)
+	uTimeout := upgrade_timeout_check(n.UpgradeTimeout)
+	if n.RecordDir != o.RecordDir || !addresses_equal(AddressList(n.RecordChannels), AddressList(o.RecordChannels)) {
+		record_check(n.RecordDir, n.RecordChannels)
+	}
+	rl.Lock()
+	logFormat = format
+	logSecrets = n.LogSecrets
+	logRedact = n.LogRedact
+	logMaxSize = lMaxSize
+	logMaxAge = lMaxAge
+	logMaxFiles = lMaxFiles
+	logCompress = n.LogCompress
+	loglevel = level
+	upgradeTimeout = uTimeout
+	rl.Unlock()
+	log_rotate_set(log_rotate_get())
+	defaultHub.SetOptions(opts)
+
+	if n.Cert != o.Cert || n.Key != o.Key {
+		certFile, _ := certs.Files()
+		if certFile == "" || default_cert_file(n.Cert) || default_key_file(n.Key) {
+			// Self-signed certificates are only generated at startup.
+			Log(LOG_INFO, "cert_file and key_file can't be changed to or from a generated certificate while the server is running.")
+		} else {
+			err = certs.SetFiles(n.Cert, n.Key)
+			if err != nil {
+				Log_error("Unable to load the certificate file " + n.Cert + " and key file " + n.Key + ". The certificate from " + certFile + " will remain in use.\r\n" + err.Error())
+			} else {
+				changes++
+				Log(LOG_INFO, "cert_file changed from \""+o.Cert+"\" to \""+n.Cert+"\", key_file changed from \""+o.Key+"\" to \""+n.Key+"\""+cert_expiry(certs))
+				o.Cert = n.Cert
+				o.Key = n.Key
+			}
+		}
+		n.Cert = o.Cert
+		n.Key = o.Key
+	} else {
+		certs.reload_log()
+	}
+
+	if !addresses_equal(n.Addresses, o.Addresses) {
+		changes++
+		if systemdActivated {
+			Log(LOG_INFO, "addresses changed from "+addresses_string(o.Addresses)+" to "+addresses_string(n.Addresses)+", but the server is listening on the sockets given to it by systemd, so this has no effect.")
+		} else {
+			Log(LOG_INFO, "addresses changed from "+addresses_string(o.Addresses)+" to "+addresses_string(n.Addresses))
+			servers_update(n.Addresses)
+		}
+	}
+
+	restart := reload_restart(o, n)
+	if len(restart) > 0 {
+		Log(LOG_INFO, "The following parameters have changed, but can't be changed while the server is running. Restart the server to apply them: "+strings.Join(restart, ", "))
+	}
+	runCfg = n
+	if changes == 0 && len(restart) == 0 {
+		Log(LOG_INFO, "Configuration reloaded. Nothing has changed.")
+		return
+	}
+	Log(LOG_INFO, "Configuration reloaded. "+strconv.Itoa(changes)+" parameters have been applied.")
+}
+
+// Combine the running configuration with a newly read one, keeping anything given on the command line.
+func cfg_merge(o, c *Cfg) *Cfg {
+	n := *c
+	for _, st := range cfgSettings {
+		if flagsSet[st.flag] {
+			cfg_keep(st.value(&n), st.value(o))
+		}
+	}
+	if len(n.Addresses) == 0 {
+		n.Addresses = o.Addresses
+	}
+	return &n
+}
+
+func reload_restart(o, n *Cfg) []string {
+	var restart []string
+	for _, st := range cfgSettings {
+		if st.reload == reloadRestart && !cfg_equal(st.value(n), st.value(o)) {
+			restart = append(restart, st.name)
+		}
+	}
+	if len(restart) > 0 {
+		// Keep reporting these until the server is restarted.
+		for _, st := range cfgSettings {
+			if st.reload == reloadRestart {
+				cfg_keep(st.value(n), st.value(o))
+			}
+		}
+	}
+	return restart
+}
+
+func addresses_equal(a, b AddressList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func addresses_string(a AddressList) string {
+	return "\"" + strings.Join(a, "\", \"") + "\""
+}
+
+// Start servers on new addresses, and stop servers whose addresses have been removed.
+func servers_update(list AddressList) {
+	h := defaultHub
+	h.svl.Lock()
+	defer h.svl.Unlock()
+	keep := make(map[string]bool)
+	for _, addr := range list {
+		if address_valid(addr) != nil {
+			Log_error("The address " + addr + " is invalid and will be ignored.")
+			continue
+		}
+		keep[addr] = true
+	}
+	running := make([]*Server, 0, len(h.servers))
+	for _, s := range h.servers {
+		if s.wsPath != "" {
+			// The WebSocket server isn't given by the addresses parameter.
+			running = append(running, s)
+			continue
+		}
+		if keep[s.address] {
+			running = append(running, s)
+			delete(keep, s.address)
+			continue
+		}
+		Log(LOG_INFO, "Stopping server listening on address "+s.address+". Any clients connected to it will be disconnected.")
+		s.Stop()
+	}
+	for _, addr := range list {
+		if !keep[addr] {
+			continue
+		}
+		delete(keep, addr)
+		s := h.newServer(addr, tlsConfig)
+		s.proxy = proxyAddresses.Contains(addr)
+		err := s.Listen()
+		if err != nil {
+			Log_error("Unable to listen on address " + addr + ".\r\n" + err.Error())
+			continue
+		}
+		Log(LOG_INFO, "Started server listening on address "+addr)
+		running = append(running, s)
+	}
+	h.servers = running
+}
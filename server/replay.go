@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const replayUsage = `Usage: nvdaRemoteServer replay [-address host:port] [-channel name] [-speed 1] file
+
+Replay a channel recording against a server, with a test client standing in for every client in the recording. Each test client joins when the recorded client joined, leaves when it left, and sends what it sent, with the same timing. Once the recording has ended, the number of messages each test client was expected to receive is compared with the number it received.
+
+If no address is given, the recording is replayed against a server started inside this command, with the default settings, listening on a random local port. Otherwise, only use this against a test server. The certificate of the server isn't verified.
+`
+
+// Seconds to wait for a test client to join its channel, and for the last messages to arrive once the recording has ended.
+const replay_wait_sec int = 5
+
+// Messages sent by the server, rather than relayed from another client.
+var replay_server_types = map[string]bool{
+	"ping":               true,
+	"channel_joined":     true,
+	"client_joined":      true,
+	"client_left":        true,
+	"motd":               true,
+	"nvda_not_connected": true,
+	"error":              true,
+}
+
+// A test client standing in for a recorded client.
+type replayClient struct {
+	id       int
+	ctype    string
+	conn     *tls.Conn
+	joined   chan struct{}
+	done     chan struct{}
+	sent     int
+	expected int
+	received atomic.Int64
+}
+
+type replayer struct {
+	address string
+	channel string
+	tls     *tls.Config
+	clients map[int]*replayClient
+	// Every test client, in the order they joined.
+	order []*replayClient
+	wg    sync.WaitGroup
+}
+
+// Replay a recording, returning the exit code.
+func Replay(args []string) int {
+	var address, channel string
+	var speed float64
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	fs.Usage = func() {
+		fmt.Print(replayUsage + "\nParameters:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&address, "address", "", "Address of the server to replay the recording against. If this is empty, a server is started inside this command on a random local port.")
+	fs.StringVar(&channel, "channel", "", "Channel for the test clients to join. If this is empty, a random channel will be used.")
+	fs.Float64Var(&speed, "speed", 1, "How fast to replay the recording. A value of 2 is twice as fast, and 0 sends every message without waiting.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || speed < 0 {
+		fs.Usage()
+		return 2
+	}
+	h, entries, err := replay_read(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read the recording "+fs.Arg(0)+"\n"+err.Error())
+		return 1
+	}
+	if address == "" {
+		hub, addr, err := replay_hub()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to start a server to replay the recording against.\n"+err.Error())
+			return 1
+		}
+		defer hub.Stop()
+		address = addr
+	}
+	if channel == "" {
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+		channel = "replay_" + hex.EncodeToString(b)
+	}
+	r := &replayer{
+		address: address,
+		channel: channel,
+		tls:     &tls.Config{InsecureSkipVerify: true},
+		clients: make(map[int]*replayClient),
+	}
+	fmt.Println("Replaying " + strconv.Itoa(len(entries)) + " messages recorded in channel " + h.Channel + " at " + h.Start + ", in channel " + channel + " on " + address)
+	err = r.run(entries, speed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		r.close()
+		return 1
+	}
+	return r.report()
+}
+
+// Start a hub with the default settings and a generated certificate, listening on a random local port. Only errors are logged.
+func replay_hub() (*Hub, string, error) {
+	config, err := gen_cert()
+	if err != nil {
+		return nil, "", err
+	}
+	opts := DefaultOptions()
+	opts.LogLevel = LOG_SILENT
+	h := NewHub(opts)
+	s := h.NewServer("127.0.0.1:0", config)
+	if h.Start() == 0 {
+		return nil, "", errors.New("Unable to listen on a local port.")
+	}
+	return h, s.addr(), nil
+}
+
+func replay_read(file string) (recordHeader, []recordEntry, error) {
+	var h recordHeader
+	f, err := os.Open(fullPath(file))
+	if err != nil {
+		return h, nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var entries []recordEntry
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var derr error
+			if n == 1 {
+				derr = json.Unmarshal(line, &h)
+				if derr == nil && h.Version != record_version {
+					derr = errors.New("Recording version " + strconv.Itoa(h.Version) + " is not supported.")
+				}
+			} else {
+				var e recordEntry
+				derr = json.Unmarshal(line, &e)
+				entries = append(entries, e)
+			}
+			if derr != nil {
+				return h, nil, errors.New("Line " + strconv.Itoa(n) + " is invalid.\n" + derr.Error())
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return h, nil, err
+		}
+	}
+	if h.Version == 0 {
+		return h, nil, errors.New("The recording is empty.")
+	}
+	return h, entries, nil
+}
+
+// Replay every entry with its recorded timing.
+func (r *replayer) run(entries []recordEntry, speed float64) error {
+	var last int64
+	for _, e := range entries {
+		if speed > 0 && e.T > last {
+			time.Sleep(time.Duration(float64(e.T-last) / speed * float64(time.Millisecond)))
+		}
+		if e.T > last {
+			last = e.T
+		}
+		if e.From == 0 {
+			err := r.server(e)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		r.send(e)
+	}
+	time.Sleep(time.Duration(replay_wait_sec) * time.Second)
+	r.close()
+	return nil
+}
+
+func (r *replayer) server(e recordEntry) error {
+	var d Data
+	if json.Unmarshal(e.M, &d) != nil || d.Client == nil {
+		return nil
+	}
+	switch d.Type {
+	case "client_joined":
+		return r.join(d.Client.ID, d.Client.ConnectionType)
+	case "client_left":
+		if rc := r.clients[d.Client.ID]; rc != nil {
+			// Messages the server sent before the client left are still read, until the server closes the connection.
+			_ = rc.conn.CloseWrite()
+			delete(r.clients, d.Client.ID)
+		}
+	}
+	return nil
+}
+
+// Connect a test client for a recorded client, and wait for it to join the channel.
+func (r *replayer) join(id int, ctype string) error {
+	if r.clients[id] != nil {
+		return nil
+	}
+	d := &net.Dialer{Timeout: time.Duration(replay_wait_sec) * time.Second}
+	conn, err := tls.DialWithDialer(d, "tcp", r.address, r.tls)
+	if err != nil {
+		return errors.New("Unable to connect a test client for client " + strconv.Itoa(id) + " to " + r.address + "\n" + err.Error())
+	}
+	rc := &replayClient{
+		id:     id,
+		ctype:  ctype,
+		conn:   conn,
+		joined: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	r.clients[id] = rc
+	r.order = append(r.order, rc)
+	r.wg.Add(1)
+	go rc.listen(&r.wg)
+	for _, d := range []Data{
+		{Type: "protocol_version", Version: 2},
+		{Type: "join", Channel: r.channel, ConnectionType: ctype},
+	} {
+		b, _ := Encode(d)
+		_, err = conn.Write(append(b, '\n'))
+		if err != nil {
+			return errors.New("Unable to join the channel with the test client for client " + strconv.Itoa(id) + "\n" + err.Error())
+		}
+	}
+	select {
+	case <-rc.joined:
+		return nil
+	case <-rc.done:
+	case <-time.After(time.Duration(replay_wait_sec) * time.Second):
+	}
+	return errors.New("The test client for client " + strconv.Itoa(id) + " was unable to join the channel.")
+}
+
+// Count the messages relayed to a test client.
+func (rc *replayClient) listen(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(rc.done)
+	br := bufio.NewReader(rc.conn)
+	joined := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var d Data
+		if json.Unmarshal(line, &d) != nil {
+			rc.received.Add(1)
+			continue
+		}
+		if d.Type == "channel_joined" && !joined {
+			joined = true
+			close(rc.joined)
+		}
+		if !replay_server_types[d.Type] {
+			rc.received.Add(1)
+		}
+	}
+}
+
+// Send a recorded message from its test client, and count it towards every client it was sent to.
+func (r *replayer) send(e recordEntry) {
+	rc := r.clients[e.From]
+	if rc == nil {
+		return
+	}
+	for _, id := range e.To {
+		if to := r.clients[id]; to != nil {
+			to.expected++
+		}
+	}
+	rc.sent++
+	_, _ = rc.conn.Write(append(replay_message(e), '\n'))
+}
+
+// The message as the client sent it, without the origin added by the server.
+func replay_message(e recordEntry) []byte {
+	if e.M == nil {
+		return []byte(e.Raw)
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(e.M, &m) != nil {
+		return e.M
+	}
+	delete(m, "origin")
+	b, err := json.Marshal(m)
+	if err != nil {
+		return e.M
+	}
+	return b
+}
+
+func (r *replayer) close() {
+	for _, rc := range r.order {
+		_ = rc.conn.Close()
+	}
+	r.wg.Wait()
+}
+
+// Print what every test client sent and received, returning 1 if any of them didn't receive what they were expected to.
+func (r *replayer) report() int {
+	sort.Slice(r.order, func(i, j int) bool {
+		return r.order[i].id < r.order[j].id
+	})
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tTYPE\tSENT\tEXPECTED\tRECEIVED")
+	for _, rc := range r.order {
+		received := int(rc.received.Load())
+		if received != rc.expected {
+			failed++
+		}
+		fmt.Fprintln(w, strconv.Itoa(rc.id)+"\t"+rc.ctype+"\t"+strconv.Itoa(rc.sent)+"\t"+strconv.Itoa(rc.expected)+"\t"+strconv.Itoa(received))
+	}
+	_ = w.Flush()
+	if failed > 0 {
+		fmt.Println(strconv.Itoa(failed) + " test clients didn't receive the number of messages they were expected to.")
+		return 1
+	}
+	fmt.Println("Every test client received the messages it was expected to.")
+	return 0
+}
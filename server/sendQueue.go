@@ -0,0 +1,168 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	queuePolicyDisconnect string = "disconnect"
+	queuePolicyDropOldest string = "drop_oldest"
+	queuePolicyBlock      string = "block"
+)
+
+// How many times its depth a queue with the drop_oldest policy can grow to with control messages, before the client is disconnected.
+const queue_overflow int = 2
+
+type queueSettings struct {
+	depth   int
+	policy  string
+	timeout time.Duration
+}
+
+func (h *Hub) sendQueue() queueSettings {
+	h.rl.RLock()
+	defer h.rl.RUnlock()
+	return queueSettings{
+		depth:   h.opts.SendQueueDepth,
+		policy:  h.opts.SendQueuePolicy,
+		timeout: time.Duration(h.opts.SendQueueTimeout) * time.Second,
+	}
+}
+
+// A message waiting to be sent. Control messages are never dropped.
+type queuedMessage struct {
+	data    []byte
+	control bool
+}
+
+// Messages waiting to be written to a single client. What happens when the queue is full depends on its policy.
+type sendQueue struct {
+	sync.Mutex
+	queueSettings
+	items  []queuedMessage
+	closed bool
+	// Set once a message has been dropped, until the queue empties, so a slow client is only logged once.
+	dropping bool
+	// Signaled when a message has been added.
+	ready chan struct{}
+	// Signaled when a message has been removed.
+	space chan struct{}
+}
+
+func newSendQueue(qs queueSettings) *sendQueue {
+	return &sendQueue{
+		queueSettings: qs,
+		items:         make([]queuedMessage, 0, qs.depth),
+		ready:         make(chan struct{}, 1),
+		space:         make(chan struct{}, 1),
+	}
+}
+
+func queue_signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Add a message, returning how many were dropped, whether that's the first drop, and false to disconnect.
+func (q *sendQueue) push(m queuedMessage, done <-chan struct{}) (int, bool, bool) {
+	var timer *time.Timer
+	for {
+		q.Lock()
+		if q.closed {
+			q.Unlock()
+			return 0, false, true
+		}
+		if len(q.items) < q.depth {
+			q.items = append(q.items, m)
+			q.Unlock()
+			queue_signal(q.ready)
+			return 0, false, true
+		}
+		switch q.policy {
+		case queuePolicyDropOldest:
+			first := !q.dropping
+			for i := range q.items {
+				if !q.items[i].control {
+					q.dropping = true
+					q.items = append(q.items[:i], q.items[i+1:]...)
+					q.items = append(q.items, m)
+					q.Unlock()
+					return 1, first, true
+				}
+			}
+			if m.control && len(q.items) < q.depth*queue_overflow {
+				// Control messages are never dropped, so the queue grows past its depth, up to a limit.
+				q.items = append(q.items, m)
+				q.Unlock()
+				queue_signal(q.ready)
+				return 0, false, true
+			}
+			if m.control {
+				q.Unlock()
+				return 1, true, false
+			}
+			q.dropping = true
+			q.Unlock()
+			return 1, first, true
+		case queuePolicyBlock:
+			q.Unlock()
+			if timer == nil && q.timeout > 0 {
+				timer = time.NewTimer(q.timeout)
+				defer timer.Stop()
+			}
+			var expired <-chan time.Time
+			if timer != nil {
+				expired = timer.C
+			}
+			select {
+			case <-q.space:
+				continue
+			case <-done:
+				return 0, false, true
+			case <-expired:
+				return 1, true, false
+			}
+		default:
+			q.Unlock()
+			return 1, true, false
+		}
+	}
+}
+
+// Wait for the next message, returning false once the queue has been closed.
+func (q *sendQueue) pop(done <-chan struct{}) ([]byte, bool) {
+	for {
+		q.Lock()
+		if q.closed {
+			q.Unlock()
+			return nil, false
+		}
+		if len(q.items) > 0 {
+			m := q.items[0]
+			q.items[0] = queuedMessage{}
+			q.items = q.items[1:]
+			if len(q.items) == 0 {
+				q.dropping = false
+			}
+			q.Unlock()
+			queue_signal(q.space)
+			return m.data, true
+		}
+		q.Unlock()
+		select {
+		case <-q.ready:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+func (q *sendQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.items = nil
+}
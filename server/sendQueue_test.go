@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connect a client to a pipe that isn't read until the test does.
+func queue_client(t *testing.T, depth int, policy string, timeout int) (*Hub, *Client, net.Conn) {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.LogLevel = LOG_SILENT
+	opts.AuthTimeout = 0
+	opts.SendQueueDepth = depth
+	opts.SendQueuePolicy = policy
+	opts.SendQueueTimeout = timeout
+	h := NewHub(opts)
+	s := h.newServer("pipe", nil)
+	s.ctx, s.Stop = context.WithCancel(h.ctx)
+	local, peer := net.Pipe()
+	c := s.newClient(local, "192.0.2.1")
+	go c.listen()
+	t.Cleanup(func() {
+		peer.Close()
+		h.stop()
+		s.Wait()
+	})
+	// Queue a message and wait for the writer to take it, leaving the writer stuck until the peer reads.
+	c.Send([]byte("blocker"))
+	queue_wait(t, c, 0)
+	return h, c, peer
+}
+
+func queue_wait(t *testing.T, c *Client, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.sq.Lock()
+		waiting := len(c.sq.items)
+		c.sq.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The send queue has %d messages waiting, expected %d.", waiting, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func queue_closed(c *Client) bool {
+	select {
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func queue_read(peer net.Conn, expected ...string) error {
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(peer)
+	for _, e := range expected {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Expected %q, got an error: %v", e, err)
+		}
+		if line != e+"\n" {
+			return fmt.Errorf("Expected %q, got %q", e, line)
+		}
+	}
+	return nil
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	h, c, _ := queue_client(t, 2, queuePolicyDisconnect, 0)
+	c.Relay([]byte("r1"))
+	c.Relay([]byte("r2"))
+	if queue_closed(c) {
+		t.Fatal("The client was disconnected before its send queue was full.")
+	}
+	start := time.Now()
+	c.Relay([]byte("r3"))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Relaying to a full queue took %v.", elapsed)
+	}
+	if !queue_closed(c) {
+		t.Fatal("The client wasn't disconnected when its send queue was full.")
+	}
+	if n := h.stats.queueDisconnects.Load(); n != 1 {
+		t.Fatalf("Expected 1 send queue disconnect, got %d.", n)
+	}
+	if n := h.stats.queueDropped.Load(); n != 1 {
+		t.Fatalf("Expected 1 dropped message, got %d.", n)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	h, c, peer := queue_client(t, 3, queuePolicyDropOldest, 0)
+	c.Relay([]byte("r1"))
+	c.Send([]byte("c1"))
+	c.Relay([]byte("r2"))
+	// Each of these drops the oldest relayed message, keeping c1.
+	c.Relay([]byte("r3"))
+	c.Send([]byte("c2"))
+	c.Send([]byte("c3"))
+	queue_wait(t, c, 3)
+	// Only control messages are left, so the relayed message is dropped and the control message is kept past the depth.
+	c.Relay([]byte("r4"))
+	c.Send([]byte("c4"))
+	queue_wait(t, c, 4)
+	if queue_closed(c) {
+		t.Fatal("The client was disconnected with the drop_oldest policy.")
+	}
+	if n := h.stats.queueDropped.Load(); n != 4 {
+		t.Fatalf("Expected 4 dropped messages, got %d.", n)
+	}
+	if n := h.stats.queueDisconnects.Load(); n != 0 {
+		t.Fatalf("Expected no send queue disconnects, got %d.", n)
+	}
+	if err := queue_read(peer, "blocker", "c1", "c2", "c3", "c4"); err != nil {
+		t.Fatal(err)
+	}
+	// Once the queue has room, relayed messages are delivered again.
+	c.Relay([]byte("r5"))
+	if err := queue_read(peer, "r5"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendQueueDropOldestOverflow(t *testing.T) {
+	h, c, _ := queue_client(t, 2, queuePolicyDropOldest, 0)
+	// Control messages are kept past the depth, up to twice the depth.
+	for i := 1; i <= 4; i++ {
+		c.Send([]byte(fmt.Sprintf("c%d", i)))
+	}
+	queue_wait(t, c, 4)
+	if queue_closed(c) {
+		t.Fatal("The client was disconnected before its send queue reached the overflow limit.")
+	}
+	c.Send([]byte("c5"))
+	if !queue_closed(c) {
+		t.Fatal("The client wasn't disconnected once its send queue passed the overflow limit.")
+	}
+	if n := h.stats.queueDisconnects.Load(); n != 1 {
+		t.Fatalf("Expected 1 send queue disconnect, got %d.", n)
+	}
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	h, c, peer := queue_client(t, 1, queuePolicyBlock, 1)
+	c.Relay([]byte("r1"))
+	read := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		read <- queue_read(peer, "blocker", "r1", "r2")
+	}()
+	// The slow reader makes room before the timeout, so the sender waits and the message is delivered.
+	start := time.Now()
+	c.Relay([]byte("r2"))
+	elapsed := time.Since(start)
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Relaying to a full queue took %v, expected to wait for the reader.", elapsed)
+	}
+	if queue_closed(c) {
+		t.Fatal("The client was disconnected while the sender was waiting for room.")
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	if n := h.stats.queueDropped.Load(); n != 0 {
+		t.Fatalf("Expected no dropped messages, got %d.", n)
+	}
+}
+
+func TestSendQueueBlockTimeout(t *testing.T) {
+	h, c, _ := queue_client(t, 1, queuePolicyBlock, 1)
+	c.Relay([]byte("r1"))
+	// Nothing reads from the pipe, so the client is disconnected once the timeout has passed.
+	start := time.Now()
+	c.Relay([]byte("r2"))
+	elapsed := time.Since(start)
+	if elapsed < time.Second || elapsed > 3*time.Second {
+		t.Fatalf("Relaying to a stalled client took %v, expected the 1s timeout.", elapsed)
+	}
+	if !queue_closed(c) {
+		t.Fatal("The stalled client wasn't disconnected after the send queue timeout.")
+	}
+	if n := h.stats.queueDisconnects.Load(); n != 1 {
+		t.Fatalf("Expected 1 send queue disconnect, got %d.", n)
+	}
+	if n := h.stats.queueDropped.Load(); n != 1 {
+		t.Fatalf("Expected 1 dropped message, got %d.", n)
+	}
+}
@@ -3,133 +3,192 @@ package server
 import (
 	"runtime"
 	"strconv"
-	"sync"
 )
 
-var (
-	sl         sync.Mutex
-	EndMessage byte = '\n'
-	lastID     int  = 0
-	clients    map[*Client]struct{}
-	channels   map[string]*ClientChannel
-)
+var EndMessage byte = '\n'
 
-func AddClient(c *Client) {
-	sl.Lock()
-	defer sl.Unlock()
-	lastID++
-	c.SetID(lastID)
-	if clients == nil {
-		clients = make(map[*Client]struct{})
-	}
-	clients[c] = struct{}{}
-	Log(LOG_CONNECTION, "Client "+strconv.Itoa(lastID)+" has connected from "+c.GetIP())
+func (h *Hub) AddClient(c *Client) {
+	h.sl.Lock()
+	h.lastID++
+	id := h.lastID
+	c.SetID(id)
+	if h.clients == nil {
+		h.clients = make(map[*Client]struct{})
+	}
+	h.clients[c] = struct{}{}
+	h.sl.Unlock()
+	ip := c.GetIP()
+	h.Log(LOG_CONNECTION, "Client", id, "has connected from", ip, log_fields("client_connected").Client(id).IP(ip))
+	h.audit(auditEntry{Event: "client_connected", Client: id, IP: ip})
 }
 
-func FindClient(c *Client) bool {
-	sl.Lock()
-	defer sl.Unlock()
-	if clients == nil {
+func (h *Hub) FindClient(c *Client) bool {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	if h.clients == nil {
 		return false
 	}
-	_, exists := clients[c]
+	_, exists := h.clients[c]
 	return exists
 }
 
-func RemoveClient(c *Client) {
-	if !FindClient(c) {
-		Log(LOG_DEBUG, "Client "+strconv.Itoa(c.GetID())+" is already disconnected.")
+func (h *Hub) FindClientID(id int) *Client {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	for c := range h.clients {
+		if c.GetID() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (h *Hub) clientCount() int {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	return len(h.clients)
+}
+
+func (h *Hub) RemoveClient(c *Client) {
+	if !h.FindClient(c) {
+		h.Log(LOG_DEBUG, "Client", c.GetID(), "is already disconnected.", log_fields("client_disconnected").Client(c.GetID()))
 		return
 	}
 	cc := c.GetChannel()
 	if cc != nil {
 		cc.Remove(c)
 	}
-	sl.Lock()
-	defer sl.Unlock()
-	Log(LOG_CONNECTION, "Client "+strconv.Itoa(c.GetID())+" has disconnected.")
-	delete(clients, c)
-	if len(clients) == 0 {
-		clients = nil
-		Log(LOG_DEBUG, "There are no clients connected to the server.")
+	id, ip := c.GetID(), c.GetIP()
+	h.sl.Lock()
+	delete(h.clients, c)
+	empty := len(h.clients) == 0
+	if empty {
+		h.clients = nil
+	}
+	h.sl.Unlock()
+	h.Log(LOG_CONNECTION, "Client", id, "has disconnected.", log_fields("client_disconnected").Client(id).IP(ip))
+	h.audit(auditEntry{Event: "client_disconnected", Client: id, IP: ip})
+	if empty {
+		h.Log(LOG_DEBUG, "There are no clients connected to the server.", log_fields("no_clients"))
 	}
 }
 
-func AddChannel(name, password string, locked bool, c *Client) {
-	sl.Lock()
-	defer sl.Unlock()
-	if channels == nil {
-		channels = make(map[string]*ClientChannel)
-	}
-	logstr := "Channel " + name + " has been created."
+func (h *Hub) AddChannel(name, password string, locked bool, c *Client) {
+	logstr := "Channel " + h.secret(name) + " has been created."
 	if locked {
 		logstr += " This is a locked channel. "
 		if password != "" {
-			logstr += "Clients can control a computer with the password " + password
+			logstr += "Clients can control a computer with the password " + h.secret(password)
 		} else {
 			logstr += "No computers can be controlled on this channel."
 		}
 	}
-	Log(LOG_CHANNEL, logstr)
-	cc := NewClientChannel(name, password, locked, c)
-	channels[name] = cc
+	h.Log(LOG_CHANNEL, logstr, log_fields("channel_created").Client(c.GetID()).IP(c.GetIP()).Channel(name))
+	h.audit(auditEntry{Event: "channel_created", Client: c.GetID(), IP: c.GetIP(), Channel: name})
+	// The recording is opened before the channel is added, so creating its file doesn't hold up every other client.
+	rec := h.recordStart(name, password)
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	if h.channels == nil {
+		h.channels = make(map[string]*ClientChannel)
+	}
+	h.channels[name] = newClientChannel(name, password, locked, c, rec)
 }
 
-func FindChannel(name string) *ClientChannel {
-	sl.Lock()
-	defer sl.Unlock()
-	if channels == nil {
+func (h *Hub) FindChannel(name string) *ClientChannel {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	if h.channels == nil {
 		return nil
 	}
-	c, exists := channels[name]
+	c, exists := h.channels[name]
 	if !exists {
 		return nil
 	}
 	return c
 }
 
-func RemoveChannel(name string) {
-	c := FindChannel(name)
-	if c == nil {
+func (h *Hub) channelList() []*ClientChannel {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	ccl := make([]*ClientChannel, 0, len(h.channels))
+	for _, cc := range h.channels {
+		ccl = append(ccl, cc)
+	}
+	return ccl
+}
+
+func (h *Hub) clientList() []*Client {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	cl := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		cl = append(cl, c)
+	}
+	return cl
+}
+
+func (h *Hub) channelCount() int {
+	h.sl.Lock()
+	defer h.sl.Unlock()
+	return len(h.channels)
+}
+
+func (h *Hub) RemoveChannel(name string) {
+	h.sl.Lock()
+	if _, exists := h.channels[name]; !exists {
+		h.sl.Unlock()
 		return
 	}
-	sl.Lock()
-	defer sl.Unlock()
-	delete(channels, name)
-	Log(LOG_CHANNEL, "Channel "+name+" has been removed.")
-	if len(channels) == 0 {
-		channels = nil
-		Log(LOG_DEBUG, "There are no channels on the server.")
+	delete(h.channels, name)
+	empty := len(h.channels) == 0
+	if empty {
+		h.channels = nil
+	}
+	h.sl.Unlock()
+	h.Log(LOG_CHANNEL, "Channel", h.secret(name), "has been removed.", log_fields("channel_removed").Channel(name))
+	h.audit(auditEntry{Event: "channel_removed", Channel: name})
+	if empty {
+		h.Log(LOG_DEBUG, "There are no channels on the server.", log_fields("no_channels"))
 	}
 }
 
-func MessageReceived(c *Client, pmsg []byte) {
+func (h *Hub) MessageReceived(c *Client, pmsg []byte) {
 	var err error
 	id := c.GetID()
-	if !FindClient(c) {
-		Log_error("A client object was not found from the connection receiving a message, number " + strconv.Itoa(id) + ". Unexpected behavior encountered. Closing connection.")
+	if !h.FindClient(c) {
+		h.Log_error("A client object was not found from the connection receiving a message, number "+strconv.Itoa(id)+". Unexpected behavior encountered. Closing connection.", log_fields("client_missing").Client(id))
 		runtime.Goexit()
 	}
 	cc := c.GetChannel()
 	if cc != nil {
-		if sendOrigin {
+		if h.sendOrigin() {
 			pmsg, err = JsonAdd(pmsg, "origin", id)
 			if err != nil {
-				Log(LOG_DEBUG, "Error adding origin to message from client "+strconv.Itoa(id)+".\r\n"+err.Error()+"\r\nSending to all clients without origin field.")
+				h.Log(LOG_DEBUG, "Error adding origin to message from client "+strconv.Itoa(id)+".\r\n"+err.Error()+"\r\nSending to all clients without origin field.", log_fields("origin_error").Client(id).Channel(cc.Name()))
 			}
 		}
 		cc.SendOthers(pmsg, c)
 		return
 	}
-	authErr := Authorize(c, pmsg)
+	c.CommandReceived()
+	if !c.s.limits.command(c.GetIP()) {
+		h.Log(LOG_DEBUG, "Client", id, "has exceeded the command rate limit. Closing connection.", log_fields("rate_limited").Client(id).IP(c.GetIP()))
+		c.Close()
+		runtime.Goexit()
+	}
+	authErr := h.Authorize(c, pmsg)
 	if authErr != nil {
-		Log(LOG_DEBUG, "Authorization failure for client "+strconv.Itoa(id)+".\r\n"+authErr.Error())
+		h.stats.authFailures.Add(1)
+		h.Log(LOG_DEBUG, "Authorization failure for client "+strconv.Itoa(id)+".\r\n"+authErr.Error(), log_fields("auth_failure").Client(id).IP(c.GetIP()))
+		h.audit(auditEntry{Event: "auth_failure", Client: id, IP: c.GetIP(), Reason: authErr.Error()})
+		h.bans.Fail(c.GetIP(), authErr.Error())
 		c.Close()
 		runtime.Goexit()
 	}
 }
 
-func Authorize(c *Client, data []byte) error {
+func (h *Hub) Authorize(c *Client, data []byte) error {
 	decode, err := Decode(data)
 	if err != nil {
 		return err
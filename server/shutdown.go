@@ -7,7 +7,12 @@ import (
 )
 
 func Shutdown() {
+	systemd_notify("STOPPING=1")
+	admin_close()
+	metrics_close()
+	acme_http_close()
 	PidfileClear()
+	audits.Close()
 }
 
 var PanicHandle panichandler.Capture = panichandler.Capture{
@@ -3,10 +3,26 @@ package server
 import "github.com/tech10/nvdaRemoteServer/signals"
 
 func signals_init() {
-	sig := <-signals.Wait()
+	wait := signals.Wait()
+	sig := <-wait
 	Log(LOG_INFO, "Signal received to shut down. Received signal "+sig.String())
-	msl.Lock()
-	stoppingServers = true
-	StopServers()
-	msl.Unlock()
+	sec := defaultHub.drainTime()
+	if sec == 0 || defaultHub.channelCount() == 0 {
+		systemd_notify("STOPPING=1\nSTATUS=Shutting down.")
+		stop_all()
+		return
+	}
+	systemd_notify("STOPPING=1\nSTATUS=Shutting down once every channel is empty, or in " + drain_time_string(sec) + ".")
+	go defaultHub.drain(sec)
+	select {
+	case <-defaultHub.ctx.Done():
+	case sig = <-wait:
+		Log(LOG_INFO, "Signal received to shut down immediately. Received signal "+sig.String())
+		stop_all()
+	}
+}
+
+// Stop every server, disconnecting every client.
+func stop_all() {
+	defaultHub.Stop()
 }
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const systemd_listen_fds_start int = 3
+
+// Set when the server was given its listeners by systemd, rather than opening them itself.
+var systemdActivated bool
+
+// A listener passed by systemd, with the name given to it by FileDescriptorName in the socket unit.
+type systemdListener struct {
+	net.Listener
+	name string
+}
+
+// Take the listeners passed by systemd through LISTEN_FDS, if any.
+func systemd_listeners() []systemdListener {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != PID {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil
+	}
+	return listen_fds(n, strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"))
+}
+
+// Take n listening sockets, starting at the first file descriptor passed by systemd, and named in order by names.
+func listen_fds(n int, names []string) []systemdListener {
+	listeners := make([]systemdListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(systemd_listen_fds_start+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemd_listen_fds_start+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			Log_error("Unable to use the socket " + name + " passed to the server. It must be a stream socket that is listening for connections.\r\n" + err.Error())
+			continue
+		}
+		listeners = append(listeners, systemdListener{Listener: l, name: name})
+	}
+	return listeners
+}
+
+// Whether a configured address, which may leave out the IP address, refers to a listener.
+func address_match(address string, addr net.Addr) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	la, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if port != strconv.Itoa(la.Port) {
+		return false
+	}
+	if host == "" {
+		return la.IP == nil || la.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(la.IP)
+}
+
+// Create a server for every listener passed by systemd.
+func systemd_servers(listeners []systemdListener, config *tls.Config) ([]*Server, *Server) {
+	systemdActivated = true
+	servers := make([]*Server, 0, len(listeners))
+	var ws *Server
+	for _, l := range listeners {
+		address := l.Addr().String()
+		var s *Server
+		if ws == nil && !default_websocket_address(websocketAddress) && address_match(websocketAddress, l.Addr()) {
+			ws = NewWebSocket(address, websocketPath, config)
+			s = ws
+			Log(LOG_DEBUG, "Starting server listening for WebSocket connections on the socket "+l.name+" passed by systemd, at address "+address+" and the path "+websocketPath)
+		} else {
+			s = NewWithTLSConfig(address, config)
+			servers = append(servers, s)
+			Log(LOG_DEBUG, "Starting server listening on the socket "+l.name+" passed by systemd, at address "+address)
+		}
+		s.inherited = l.Listener
+		for _, p := range proxyAddresses {
+			if address_match(p, l.Addr()) {
+				s.proxy = true
+			}
+		}
+	}
+	if !default_addresses(addresses) {
+		Log(LOG_INFO, "The server has been given its sockets by systemd, so the addresses parameter is ignored. The server won't listen on any other address.")
+	}
+	return servers, ws
+}
+
+// Send a notification to systemd, if the server was started by a service of the notify type.
+func systemd_notify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		Log(LOG_DEBUG, "Unable to notify systemd.\r\n"+err.Error())
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		Log(LOG_DEBUG, "Unable to notify systemd.\r\n"+err.Error())
+	}
+}
+
+// Tell systemd the server has started, and keep its watchdog fed while the server is healthy.
+func Ready() {
+	// After an upgrade, the previous process tells systemd once this one is ready.
+	if upgradeReady == nil {
+		num := len(defaultHub.serverList())
+		systemd_notify("READY=1\nMAINPID=" + PID_STR + "\nSTATUS=Listening on " + strconv.Itoa(num) + " addresses.")
+	}
+	upgrade_ready()
+	go systemd_watchdog()
+}
+
+// Notify the systemd watchdog at half its interval, as long as every server is accepting connections.
+func systemd_watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != PID_STR {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	Log(LOG_DEBUG, "Notifying the systemd watchdog every "+interval.String())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-defaultHub.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if upgrade_done() {
+			// The new process notifies the watchdog now.
+			return
+		}
+		err = health_check()
+		if defaultHub.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if !failing {
+				failing = true
+				Log_error("The server is unhealthy, and the systemd watchdog will no longer be notified.\r\n" + err.Error())
+				systemd_notify("STATUS=" + err.Error())
+			}
+			continue
+		}
+		failing = false
+		systemd_notify("WATCHDOG=1")
+	}
+}
+
+// Check that every server is still accepting connections. This never returns if the server is deadlocked.
+func health_check() error {
+	h := defaultHub
+	h.svl.Lock()
+	defer h.svl.Unlock()
+	for _, s := range h.servers {
+		if s.accepting.Load() || s.closing.Load() {
+			continue
+		}
+		if s.wsPath != "" {
+			return errors.New("The WebSocket server at " + s.address + " is no longer accepting connections.")
+		}
+		return errors.New("The server at " + s.address + " is no longer accepting connections.")
+	}
+	h.msl.Lock()
+	h.msl.Unlock()
+	h.sl.Lock()
+	h.sl.Unlock()
+	h.rl.RLock()
+	h.rl.RUnlock()
+	rl.RLock()
+	rl.RUnlock()
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !plan9 && !windows
+// +build !plan9,!windows
+
+package server
+
+import "syscall"
+
+// Keep files created until the returned function is called private to the user.
+func umask_private() func() {
+	old := syscall.Umask(0o077)
+	return func() {
+		syscall.Umask(old)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build plan9 || windows
+// +build plan9 windows
+
+package server
+
+func umask_private() func() {
+	// There is no file creation mask on this platform, so permissions are changed after the file is created.
+	return func() {}
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tech10/nvdaRemoteServer/signals"
+)
+
+// Passed from the process being upgraded to the new process it starts.
+const (
+	upgrade_env_pid       string = "NVDAREMOTESERVER_UPGRADE_PID"
+	upgrade_env_fds       string = "NVDAREMOTESERVER_UPGRADE_FDS"
+	upgrade_env_addresses string = "NVDAREMOTESERVER_UPGRADE_ADDRESSES"
+	upgrade_env_last_id   string = "NVDAREMOTESERVER_UPGRADE_LAST_ID"
+	upgrade_env_systemd   string = "NVDAREMOTESERVER_UPGRADE_SYSTEMD"
+)
+
+// Seconds to wait for the new process to start listening.
+const upgrade_ready_sec int = 30
+
+var (
+	ul sync.Mutex
+	// Set while a new process is being started.
+	upgrading bool
+	// Set once the new process has taken over.
+	upgraded bool
+	// Written to by the new process once it has started, to tell the process it was started by.
+	upgradeReady *os.File
+	// The working directory the server was started in, since reading the configuration file can change it.
+	startDir string
+)
+
+func init() {
+	startDir, _ = os.Getwd()
+}
+
+func upgrade_timeout_get() time.Duration {
+	rl.RLock()
+	defer rl.RUnlock()
+	return time.Duration(upgradeTimeout) * time.Second
+}
+
+func upgrade_done() bool {
+	ul.Lock()
+	defer ul.Unlock()
+	return upgraded
+}
+
+func upgrade_init() {
+	usr2 := signals.Upgrade()
+	for {
+		select {
+		case <-defaultHub.ctx.Done():
+			return
+		case sig := <-usr2:
+			Log(LOG_INFO, "Signal received to upgrade the server. Received signal "+sig.String())
+			err := upgrade()
+			if err != nil {
+				Log_error("Unable to upgrade the server.\r\n" + err.Error())
+			}
+		}
+	}
+}
+
+// Start the executable again, passing it every listening socket.
+func upgrade() error {
+	ul.Lock()
+	if upgrading || upgraded {
+		ul.Unlock()
+		return errors.New("An upgrade is already in progress.")
+	}
+	if defaultHub.draining.Load() {
+		ul.Unlock()
+		return errors.New("The server is shutting down.")
+	}
+	upgrading = true
+	ul.Unlock()
+	defer func() {
+		ul.Lock()
+		upgrading = false
+		ul.Unlock()
+	}()
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return errors.New("Upgrading without a restart is not supported on " + runtime.GOOS + ".")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	servers, files, addrs, err := upgrade_files()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defaultHub.sl.Lock()
+	id := defaultHub.lastID
+	defaultHub.sl.Unlock()
+	env := make([]string, 0, len(os.Environ())+5)
+	for _, v := range os.Environ() {
+		// The new process takes over the watchdog once it is the main process of the service.
+		if strings.HasPrefix(v, "NVDAREMOTESERVER_UPGRADE_") || strings.HasPrefix(v, "WATCHDOG_PID=") {
+			continue
+		}
+		env = append(env, v)
+	}
+	env = append(env,
+		upgrade_env_pid+"="+PID_STR,
+		upgrade_env_fds+"="+strconv.Itoa(len(files)),
+		upgrade_env_addresses+"="+strings.Join(addrs, "\n"),
+		upgrade_env_last_id+"="+strconv.Itoa(id),
+	)
+	if systemdActivated {
+		env = append(env, upgrade_env_systemd+"=1")
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Dir = startDir
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+
+	// The new process opens these for itself, so they are closed here first, and opened again if it doesn't start.
+	upgrade_release()
+	Log(LOG_INFO, "Starting "+exe+" to take over "+strconv.Itoa(len(files))+" listening addresses.")
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		upgrade_restore()
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	ready := make(chan struct{})
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		if n == 1 {
+			close(ready)
+		}
+	}()
+	select {
+	case <-ready:
+	case <-exited:
+		upgrade_restore()
+		return errors.New("The new process exited before it started listening. This process will keep running.")
+	case <-time.After(time.Duration(upgrade_ready_sec) * time.Second):
+		_ = cmd.Process.Kill()
+		upgrade_restore()
+		return errors.New("The new process didn't start listening within " + strconv.Itoa(upgrade_ready_sec) + " seconds, and has been stopped. This process will keep running.")
+	}
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	ul.Lock()
+	upgraded = true
+	ul.Unlock()
+	systemd_notify("READY=1\nMAINPID=" + pid + "\nSTATUS=Upgraded. The previous process is serving its remaining clients.")
+	// The new process has written its own PID to the file.
+	PidfileRelease()
+	upgrade_audit_open()
+	for _, s := range servers {
+		s.stopAccepting()
+	}
+	Log(LOG_INFO, "The server has been upgraded, and process "+pid+" is accepting connections. This process will keep serving the "+strconv.Itoa(defaultHub.clientCount())+" clients connected to it until they disconnect.")
+	go upgrade_drain(upgrade_timeout_get())
+	return nil
+}
+
+// Duplicate the socket of every running server, to be passed to the new process, along with the address each was given.
+func upgrade_files() ([]*Server, []*os.File, []string, error) {
+	servers := defaultHub.serverList()
+	files := make([]*os.File, 0, len(servers))
+	addrs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		s.Lock()
+		raw, address := s.raw, s.address
+		s.Unlock()
+		l, ok := raw.(*net.TCPListener)
+		if !ok {
+			return servers, files, addrs, errors.New("The server at " + address + " has no socket that can be passed to another process.")
+		}
+		f, err := l.File()
+		if err != nil {
+			return servers, files, addrs, errors.New("Unable to pass the socket of the server at " + address + " to another process.\r\n" + err.Error())
+		}
+		files = append(files, f)
+		addrs = append(addrs, address)
+	}
+	return servers, files, addrs, nil
+}
+
+// Close everything the new process needs to open for itself.
+func upgrade_release() {
+	// Both processes would otherwise add to the same chain of entries. Entries added until it is known which process continues it are kept.
+	defaultHub.audit(auditEntry{Event: "upgrade_started"})
+	audits.Hold()
+	admin_close()
+	metrics_close()
+	acme_http_close()
+}
+
+// Open everything closed for the new process again, if it didn't start.
+func upgrade_restore() {
+	// The new process writes its PID before it tells this one it is ready, so it may have replaced this one.
+	PidfileSet()
+	err := audits.Open(auditFile, auditKeyFile)
+	if err != nil {
+		audits.Close()
+		Log_error("Unable to open the audit file " + auditFile + " again. No audit trail will be kept.\r\n" + err.Error())
+	}
+	defaultHub.audit(auditEntry{Event: "upgrade_failed"})
+	err = admin_listen(adminSocket)
+	if err != nil {
+		Log_error("Unable to listen on admin socket " + adminSocket + " again.\r\n" + err.Error())
+	}
+	err = metrics_listen(metricsAddress)
+	if err != nil {
+		Log_error("Unable to serve metrics on address " + metricsAddress + " again.\r\n" + err.Error())
+	}
+	err = acme_http_listen(acmeHTTPAddress, acmeManager)
+	if err != nil {
+		Log_error("Unable to answer ACME HTTP-01 challenges on address " + acmeHTTPAddress + " again.\r\n" + err.Error())
+	}
+}
+
+// Keep auditing the clients left in this process in a file of its own, since the new process continues the audit file.
+func upgrade_audit_open() {
+	if auditFile == "" {
+		return
+	}
+	file := auditFile + "." + PID_STR
+	err := audits.Open(file, auditKeyFile)
+	if err != nil {
+		audits.Close()
+		Log_error("Unable to open the audit file " + file + " for the clients remaining in this process. They won't be audited.\r\n" + err.Error())
+		return
+	}
+	Log(LOG_INFO, "Auditing the clients remaining in this process in "+file)
+	defaultHub.audit(auditEntry{Event: "upgrade_handoff", Reason: "The audit file " + auditFile + " is continued by the new process."})
+}
+
+// Wait for every client to disconnect, or for the timeout to end, then stop this process.
+func upgrade_drain(timeout time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var end <-chan time.Time
+	if timeout > 0 {
+		end = time.After(timeout)
+	}
+	for defaultHub.clientCount() > 0 {
+		select {
+		case <-defaultHub.ctx.Done():
+			return
+		case <-end:
+			Log(LOG_INFO, "The upgrade timeout has ended. Disconnecting the "+strconv.Itoa(defaultHub.clientCount())+" clients remaining in this process.")
+			stop_all()
+			return
+		case <-ticker.C:
+		}
+	}
+	Log(LOG_INFO, "Every client connected to this process has disconnected. Shutting down.")
+	stop_all()
+}
+
+// Take the listening sockets passed by the process being upgraded, if this process was started by one.
+func upgrade_listeners() []systemdListener {
+	ppid := os.Getenv(upgrade_env_pid)
+	n, err := strconv.Atoi(os.Getenv(upgrade_env_fds))
+	addrs := strings.Split(os.Getenv(upgrade_env_addresses), "\n")
+	id, _ := strconv.Atoi(os.Getenv(upgrade_env_last_id))
+	activated := os.Getenv(upgrade_env_systemd) != ""
+	for _, v := range []string{upgrade_env_pid, upgrade_env_fds, upgrade_env_addresses, upgrade_env_last_id, upgrade_env_systemd} {
+		os.Unsetenv(v)
+	}
+	if ppid == "" || ppid != strconv.Itoa(os.Getppid()) || err != nil || n < 1 {
+		return nil
+	}
+	upgradeReady = os.NewFile(uintptr(systemd_listen_fds_start+n), "upgrade")
+	defaultHub.sl.Lock()
+	defaultHub.lastID = id
+	defaultHub.sl.Unlock()
+	systemdActivated = activated
+	Log(LOG_INFO, "Taking over from process "+ppid+", which is being upgraded.")
+	return listen_fds(n, addrs)
+}
+
+// Create a server for every address in the configuration, reusing the sockets that were passed.
+func upgrade_servers(listeners []systemdListener, config *tls.Config) ([]*Server, *Server) {
+	if systemdActivated {
+		return systemd_servers(listeners, config)
+	}
+	inherited := make(map[string]net.Listener, len(listeners))
+	for _, l := range listeners {
+		inherited[l.name] = l.Listener
+	}
+	servers := make([]*Server, len(addresses))
+	for i, addr := range addresses {
+		servers[i] = NewWithTLSConfig(addr, config)
+		servers[i].proxy = proxyAddresses.Contains(addr)
+		servers[i].inherited = inherited[addr]
+		delete(inherited, addr)
+		Log(LOG_DEBUG, "Starting server listening on address "+addr)
+	}
+	var ws *Server
+	if !default_websocket_address(websocketAddress) {
+		ws = NewWebSocket(websocketAddress, websocketPath, config)
+		ws.proxy = proxyAddresses.Contains(websocketAddress)
+		ws.inherited = inherited[websocketAddress]
+		delete(inherited, websocketAddress)
+		Log(LOG_DEBUG, "Starting server listening for WebSocket connections on address "+websocketAddress+" at the path "+websocketPath)
+	}
+	for addr, l := range inherited {
+		Log(LOG_INFO, "The address "+addr+" is no longer in the configuration, and won't be listened on.")
+		l.Close()
+	}
+	return servers, ws
+}
+
+// Tell the process being upgraded that this one has started.
+func upgrade_ready() {
+	if upgradeReady == nil {
+		return
+	}
+	_, _ = upgradeReady.Write([]byte{1})
+	upgradeReady.Close()
+	upgradeReady = nil
+}
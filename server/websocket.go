@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Added to the key given by a client to accept a WebSocket connection, as described by RFC 6455.
+const ws_guid string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes.
+const (
+	ws_op_continuation byte = 0x0
+	ws_op_text         byte = 0x1
+	ws_op_binary       byte = 0x2
+	ws_op_close        byte = 0x8
+	ws_op_ping         byte = 0x9
+	ws_op_pong         byte = 0xa
+)
+
+// Close status codes.
+const (
+	ws_close_normal      uint16 = 1000
+	ws_close_protocol    uint16 = 1002
+	ws_close_unsupported uint16 = 1003
+)
+
+var errWebSocketProtocol = errors.New("WebSocket protocol error.")
+
+// Accept connections for the TLS handshake once they have passed the same checks as a TCP connection.
+type wsListener struct {
+	net.Listener
+	s      *Server
+	config *tls.Config
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.s.allowed(conn); ok {
+			return tls.Server(conn, l.config), nil
+		}
+	}
+}
+
+func (s *Server) serveWebSocket(listener net.Listener, config *tls.Config, path string) {
+	defer s.accepting.Store(false)
+	s.Lock()
+	address := s.address
+	s.Unlock()
+	hs := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.upgrade(w, r, path)
+		}),
+		ReadHeaderTimeout: time.Duration(write_sec) * time.Second,
+		// Failed TLS handshakes and bad requests are common on a public address, and aren't worth logging.
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	// Stopping our server.
+	go func() {
+		<-s.ctx.Done()
+		s.hub.msl.Lock()
+		if !s.hub.stopping {
+			s.hub.Log(LOG_DEBUG, "The WebSocket server at "+address+" has received a signal to stop.")
+		}
+		s.hub.msl.Unlock()
+		hs.Close()
+		s.Done()
+	}()
+	err := hs.Serve(&wsListener{Listener: listener, s: s, config: config})
+	if s.closing.Load() {
+		s.hub.Log(LOG_DEBUG, "The WebSocket server at "+address+" has stopped accepting connections. Clients connected to it will remain connected.")
+		return
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.hub.msl.Lock()
+		if !s.hub.stopping {
+			s.hub.Log(LOG_DEBUG, "Error accepting connections on the WebSocket server at "+address+"\r\n"+err.Error()+"\r\nStopping server.")
+		}
+		s.hub.msl.Unlock()
+		s.Stop()
+	}
+}
+
+// Complete the WebSocket handshake, then handle the connection as a client in the same way as a TCP connection.
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request, path string) {
+	if r.URL.Path != path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet || !ws_header_has(r.Header, "Connection", "upgrade") || !ws_header_has(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "A WebSocket connection is required.", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Only version 13 of the WebSocket protocol is supported.", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "The Sec-WebSocket-Key header is required.", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Unable to take over the connection.", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	ip := getIP(conn)
+	if !s.limits.connect(ip) {
+		conn.Close()
+		return
+	}
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + ws_accept(key) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		s.limits.disconnect(ip)
+		conn.Close()
+		return
+	}
+	s.Lock()
+	term := s.messageTerminator
+	s.Unlock()
+	ws := &wsConn{
+		Conn: conn,
+		r:    rw.Reader,
+		term: term,
+	}
+	// The handler is finished with the connection, so the client can be handled here.
+	s.newClient(ws, ip).listen()
+}
+
+// Whether a header contains a token, ignoring case.
+func ws_header_has(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ws_accept(key string) string {
+	h := sha1.Sum([]byte(key + ws_guid))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// A WebSocket connection carrying one protocol message in each text frame.
+type wsConn struct {
+	net.Conn
+	r    *bufio.Reader
+	term byte
+	// Frames are written whole under this lock, since pings are answered while messages are being sent.
+	wl     sync.Mutex
+	closed bool
+	// The frame being read. Only touched by the goroutine reading from the connection.
+	remaining  int64
+	mask       [4]byte
+	pos        int
+	fin        bool
+	fragmented bool
+	// The end of a message has been read, so the terminator is returned before the next frame.
+	ending bool
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for ws.remaining == 0 {
+		if ws.ending {
+			ws.ending = false
+			p[0] = ws.term
+			return 1, nil
+		}
+		err := ws.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+	n, err := ws.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= ws.mask[ws.pos%4]
+		ws.pos++
+		// A terminator inside a message would split it in two. In a JSON message, it can only be whitespace, so a space means the same thing.
+		if p[i] == ws.term {
+			p[i] = ' '
+		}
+	}
+	ws.remaining -= int64(n)
+	if ws.remaining == 0 && ws.fin {
+		ws.ending = true
+	}
+	return n, err
+}
+
+// Read the header of the next frame. Control frames are handled here, leaving nothing remaining to be read.
+func (ws *wsConn) next() error {
+	var h [2]byte
+	_, err := io.ReadFull(ws.r, h[:])
+	if err != nil {
+		return err
+	}
+	fin := h[0]&0x80 != 0
+	op := h[0] & 0x0f
+	if h[0]&0x70 != 0 || h[1]&0x80 == 0 {
+		// Extensions are never negotiated, and frames from clients must be masked.
+		return ws.fail(ws_close_protocol)
+	}
+	length := int64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(ws.r, b[:])
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(ws.r, b[:])
+		length = int64(binary.BigEndian.Uint64(b[:]))
+	}
+	if err != nil {
+		return err
+	}
+	if length < 0 {
+		return ws.fail(ws_close_protocol)
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(ws.r, mask[:])
+	if err != nil {
+		return err
+	}
+	if op >= ws_op_close {
+		if !fin || length > 125 {
+			return ws.fail(ws_close_protocol)
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(ws.r, payload)
+		if err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case ws_op_close:
+			_ = ws.write(ws_op_close, ws_close_payload(ws_close_normal))
+			return io.EOF
+		case ws_op_ping:
+			return ws.write(ws_op_pong, payload)
+		case ws_op_pong:
+			return nil
+		}
+		return ws.fail(ws_close_protocol)
+	}
+	switch op {
+	case ws_op_continuation:
+		if !ws.fragmented {
+			return ws.fail(ws_close_protocol)
+		}
+	case ws_op_text:
+		if ws.fragmented {
+			return ws.fail(ws_close_protocol)
+		}
+	case ws_op_binary:
+		return ws.fail(ws_close_unsupported)
+	default:
+		return ws.fail(ws_close_protocol)
+	}
+	ws.fragmented = !fin
+	ws.fin = fin
+	ws.remaining = length
+	ws.mask = mask
+	ws.pos = 0
+	if length == 0 && fin {
+		ws.ending = true
+	}
+	return nil
+}
+
+// Close the WebSocket with a status code, returning an error for the reader.
+func (ws *wsConn) fail(status uint16) error {
+	_ = ws.write(ws_op_close, ws_close_payload(status))
+	return errWebSocketProtocol
+}
+
+func ws_close_payload(status uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, status)
+}
+
+// Send a message as a single text frame. Each call is expected to hold one message, followed by the terminator.
+func (ws *wsConn) Write(b []byte) (int, error) {
+	err := ws.write(ws_op_text, bytes.TrimSuffix(b, []byte{ws.term}))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (ws *wsConn) write(op byte, payload []byte) error {
+	ws.wl.Lock()
+	defer ws.wl.Unlock()
+	if ws.closed {
+		return net.ErrClosed
+	}
+	if op == ws_op_close {
+		ws.closed = true
+	}
+	return ws.frame(op, payload)
+}
+
+// Write a whole frame. The write lock must be held.
+func (ws *wsConn) frame(op byte, payload []byte) error {
+	b := make([]byte, 0, len(payload)+10)
+	b = append(b, 0x80|op)
+	switch {
+	case len(payload) <= 125:
+		b = append(b, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, 126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	b = append(b, payload...)
+	_, err := ws.Conn.Write(b)
+	return err
+}
+
+// Send a close frame if one hasn't been sent, then close the connection.
+func (ws *wsConn) Close() error {
+	ws.wl.Lock()
+	if !ws.closed {
+		ws.closed = true
+		_ = ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = ws.frame(ws_op_close, ws_close_payload(ws_close_normal))
+	}
+	ws.wl.Unlock()
+	return ws.Conn.Close()
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A frame as a client sends it, masked unless told otherwise. Lengths past 125 use the extended length given by the payload's size.
+func ws_test_frame(fin bool, op byte, payload string, masked bool) []byte {
+	b := []byte{op}
+	if fin {
+		b[0] |= 0x80
+	}
+	var m byte
+	if masked {
+		m = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		b = append(b, m|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, m|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, m|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i := 0; i < len(payload); i++ {
+		b = append(b, payload[i]^mask[i%4])
+	}
+	return b
+}
+
+type wsTestFrame struct {
+	op      byte
+	payload string
+}
+
+// Read the frames the server sends until the connection is closed.
+func ws_test_frames(conn net.Conn, frames chan<- wsTestFrame) {
+	defer close(frames)
+	r := bufio.NewReader(conn)
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return
+		}
+		length := uint64(h[1] & 0x7f)
+		switch length {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(b[:])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		frames <- wsTestFrame{h[0] & 0x0f, string(payload)}
+	}
+}
+
+func TestWebSocketRead(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	longer := strings.Repeat("b", 70000)
+	closeNormal := wsTestFrame{ws_op_close, string(ws_close_payload(ws_close_normal))}
+	closeProtocol := wsTestFrame{ws_op_close, string(ws_close_payload(ws_close_protocol))}
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+		// What is read from the connection, and the error that ends it.
+		read string
+		err  error
+		// The frames the server answers with.
+		sent []wsTestFrame
+	}{
+		{
+			"masked",
+			[][]byte{ws_test_frame(true, ws_op_text, `{"type":"ping"}`, true), ws_test_frame(true, ws_op_close, "", true)},
+			`{"type":"ping"}` + "\n", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"several messages",
+			[][]byte{ws_test_frame(true, ws_op_text, "one", true), ws_test_frame(true, ws_op_text, "", true), ws_test_frame(true, ws_op_text, "two", true), ws_test_frame(true, ws_op_close, "", true)},
+			"one\n\ntwo\n", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"terminator inside a message",
+			[][]byte{ws_test_frame(true, ws_op_text, "one\ntwo", true), ws_test_frame(true, ws_op_close, "", true)},
+			"one two\n", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"fragmented",
+			[][]byte{ws_test_frame(false, ws_op_text, "frag", true), ws_test_frame(false, ws_op_continuation, "men", true), ws_test_frame(true, ws_op_continuation, "ted", true), ws_test_frame(true, ws_op_close, "", true)},
+			"fragmented\n", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"ping between fragments",
+			[][]byte{ws_test_frame(false, ws_op_text, "frag", true), ws_test_frame(true, ws_op_ping, "are you there", true), ws_test_frame(true, ws_op_pong, "", true), ws_test_frame(true, ws_op_continuation, "mented", true), ws_test_frame(true, ws_op_close, "", true)},
+			"fragmented\n", io.EOF,
+			[]wsTestFrame{{ws_op_pong, "are you there"}, closeNormal},
+		},
+		{
+			"close between fragments",
+			[][]byte{ws_test_frame(false, ws_op_text, "frag", true), ws_test_frame(true, ws_op_close, "", true), ws_test_frame(true, ws_op_continuation, "mented", true)},
+			"frag", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"16 bit length",
+			[][]byte{ws_test_frame(true, ws_op_text, long, true), ws_test_frame(true, ws_op_close, "", true)},
+			long + "\n", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"64 bit length",
+			[][]byte{ws_test_frame(true, ws_op_text, longer, true), ws_test_frame(true, ws_op_close, "", true)},
+			longer + "\n", io.EOF,
+			[]wsTestFrame{closeNormal},
+		},
+		{
+			"unmasked",
+			[][]byte{ws_test_frame(true, ws_op_text, "hello", false)},
+			"", errWebSocketProtocol,
+			[]wsTestFrame{closeProtocol},
+		},
+		{
+			"binary",
+			[][]byte{ws_test_frame(true, ws_op_binary, "hello", true)},
+			"", errWebSocketProtocol,
+			[]wsTestFrame{{ws_op_close, string(ws_close_payload(ws_close_unsupported))}},
+		},
+		{
+			"continuation without a start",
+			[][]byte{ws_test_frame(true, ws_op_continuation, "hello", true)},
+			"", errWebSocketProtocol,
+			[]wsTestFrame{closeProtocol},
+		},
+		{
+			"text inside a fragmented message",
+			[][]byte{ws_test_frame(false, ws_op_text, "frag", true), ws_test_frame(true, ws_op_text, "hello", true)},
+			"frag", errWebSocketProtocol,
+			[]wsTestFrame{closeProtocol},
+		},
+		{
+			"fragmented ping",
+			[][]byte{ws_test_frame(false, ws_op_ping, "hello", true)},
+			"", errWebSocketProtocol,
+			[]wsTestFrame{closeProtocol},
+		},
+		{
+			"ping too long",
+			[][]byte{ws_test_frame(true, ws_op_ping, long, true)},
+			"", errWebSocketProtocol,
+			[]wsTestFrame{closeProtocol},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local, peer := net.Pipe()
+			defer peer.Close()
+			_ = local.SetDeadline(time.Now().Add(5 * time.Second))
+			ws := &wsConn{Conn: local, r: bufio.NewReader(local), term: '\n'}
+			input := tc.frames
+			go func() {
+				for _, f := range input {
+					if _, err := peer.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+			frames := make(chan wsTestFrame, 16)
+			go ws_test_frames(peer, frames)
+
+			var read []byte
+			// Reads smaller than a frame check that a frame can be read in pieces.
+			b := make([]byte, 1000)
+			var err error
+			for {
+				var n int
+				n, err = ws.Read(b)
+				read = append(read, b[:n]...)
+				if err != nil {
+					break
+				}
+			}
+			local.Close()
+			if err != tc.err {
+				t.Fatalf("Got the error %v, expected %v", err, tc.err)
+			}
+			if string(read) != tc.read {
+				t.Fatalf("Expected to read %.40q, got %.40q.", tc.read, read)
+			}
+			var sent []wsTestFrame
+			for f := range frames {
+				sent = append(sent, f)
+			}
+			if len(sent) != len(tc.sent) {
+				t.Fatalf("Expected the server to send %q, got %q.", tc.sent, sent)
+			}
+			for i := range sent {
+				if sent[i] != tc.sent[i] {
+					t.Fatalf("Expected the server to send %q, got %q.", tc.sent, sent)
+				}
+			}
+		})
+	}
+}
+
+// Messages are written in a single frame, with the extended length they need and the terminator removed.
+func TestWebSocketWrite(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		local, peer := net.Pipe()
+		ws := &wsConn{Conn: local, r: bufio.NewReader(local), term: '\n'}
+		frames := make(chan wsTestFrame, 4)
+		go ws_test_frames(peer, frames)
+		message := strings.Repeat("a", size)
+		n, err := ws.Write([]byte(message + "\n"))
+		if err != nil || n != size+1 {
+			t.Fatalf("Wrote %d of %d bytes: %v", n, size+1, err)
+		}
+		ws.Close()
+		peer.Close()
+		f := <-frames
+		if f.op != ws_op_text || f.payload != message {
+			t.Fatalf("Expected a text frame of %d bytes, got opcode %d with %d bytes.", size, f.op, len(f.payload))
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !plan9 && !windows
+// +build !plan9,!windows
+
+package signals
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func Reopen() chan os.Signal {
+	// Log file reopen notifier
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	return usr1
+}
+
+func Upgrade() chan os.Signal {
+	// Binary upgrade notifier
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	return usr2
+}
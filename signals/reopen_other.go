@@ -0,0 +1,16 @@
+//go:build plan9 || windows
+// +build plan9 windows
+
+package signals
+
+import "os"
+
+func Reopen() chan os.Signal {
+	// There is no signal to reopen the log file on this platform, so this never receives anything.
+	return make(chan os.Signal, 1)
+}
+
+func Upgrade() chan os.Signal {
+	// There is no signal to upgrade the server on this platform, so this never receives anything.
+	return make(chan os.Signal, 1)
+}
@@ -18,3 +18,10 @@ func Wait() chan os.Signal {
 		syscall.SIGQUIT)
 	return kill
 }
+
+func Reload() chan os.Signal {
+	// Configuration reload notifier
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	return hup
+}
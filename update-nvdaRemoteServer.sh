@@ -28,8 +28,11 @@ echo Changing ownership of binary.
 check sudo chown root:root ${program}/${binary}
 echo Moving binary to /usr/bin
 check sudo mv ${program}/${binary} /usr/bin/
-echo Restarting server.
-check sudo systemctl restart nvdaRemoteServer
+# Upgrading without a restart requires the sample service file, which is of the notify type.
+# To restart the server instead, which disconnects every client, use the following.
+# check sudo systemctl restart nvdaRemoteServer
+echo Upgrading server without disconnecting clients.
+check sudo systemctl kill --kill-whom=main --signal=USR2 nvdaRemoteServer
 }
 clean() {
 echo Cleaning up files.